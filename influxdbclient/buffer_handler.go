@@ -0,0 +1,53 @@
+package influxdbclient
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// BufferedMetric describes a series waiting for the next post.
+type BufferedMetric struct {
+	Name   string   `json:"name"`
+	Tags   []string `json:"tags"`
+	Points int      `json:"points"`
+}
+
+// BufferedMetrics returns the series buffered since the last successful post,
+// sorted by name.
+func (c *Client) BufferedMetrics() []BufferedMetric {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	metrics := make([]BufferedMetric, 0, len(c.metricPoints))
+	for key, mVal := range c.metricPoints {
+		metrics = append(metrics, BufferedMetric{
+			Name:   c.measurementName(key),
+			Tags:   tagStrings(mVal.tags),
+			Points: len(mVal.points),
+		})
+	}
+	sort.Sort(byName(metrics))
+	return metrics
+}
+
+// ServeBuffer writes the buffered metrics as JSON, for debugging.
+func (c *Client) ServeBuffer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.BufferedMetrics())
+}
+
+// tagStrings formats tags as key=value.
+func tagStrings(tags []tag) []string {
+	formatted := make([]string, 0, len(tags))
+	for _, t := range tags {
+		formatted = append(formatted, t.String())
+	}
+	return formatted
+}
+
+type byName []BufferedMetric
+
+func (m byName) Len() int           { return len(m) }
+func (m byName) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m byName) Less(i, j int) bool { return m[i].Name < m[j].Name }
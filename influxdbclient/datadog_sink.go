@@ -0,0 +1,72 @@
+package influxdbclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// datadogPayload is the JSON body accepted by the Datadog series API.
+type datadogPayload struct {
+	Series []Metric `json:"series"`
+}
+
+// SetDatadogSink makes the client also write every batch to the Datadog series API
+// at url, which is useful while migrating between the two backends. Datadog
+// failures are logged and counted but don't fail the post.
+func (c *Client) SetDatadogSink(url string, apiKey string) {
+	c.datadogURL = url
+	c.datadogAPIKey = apiKey
+}
+
+func (c *Client) postDatadog(ctx context.Context, httpClient *http.Client, points map[metricKey]metricValue) error {
+	payload, err := json.Marshal(c.datadogPayload(points))
+	if err != nil {
+		return err
+	}
+
+	req, err := c.newPostRequest(ctx, c.datadogURL+"?api_key="+c.datadogAPIKey, "application/json", "", bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 || resp.StatusCode < 200 {
+		errBody, _ := readResponseBody(resp)
+		return fmt.Errorf("datadog request returned HTTP response: %s;\n%s", resp.Status, string(errBody))
+	}
+	return nil
+}
+
+func (c *Client) datadogPayload(points map[metricKey]metricValue) datadogPayload {
+	var payload datadogPayload
+	for key, mVal := range points {
+		measurement := c.measurementName(key)
+		if _, ok := c.quarantined[measurement]; ok {
+			continue
+		}
+
+		metric := Metric{
+			Metric: measurement,
+			Type:   "gauge",
+			Host:   c.ip,
+		}
+		for _, t := range mVal.tags {
+			metric.Tags = append(metric.Tags, t.key+":"+t.value)
+		}
+		for _, point := range mVal.points {
+			timestamp := point.Timestamp / int64(time.Second)
+			metric.Points = append(metric.Points, Point{Timestamp: timestamp, Value: point.Value})
+		}
+		payload.Series = append(payload.Series, metric)
+	}
+	return payload
+}
@@ -0,0 +1,15 @@
+package influxdbclient
+
+import "net/http"
+
+type Tag = tag
+
+func NewTag(key, value string) Tag {
+	return tag{key: key, value: value}
+}
+
+var HashTags = hashTags
+
+func SetHTTPClient(c *Client, httpClient *http.Client) {
+	c.httpClient = httpClient
+}
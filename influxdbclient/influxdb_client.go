@@ -2,33 +2,171 @@ package influxdbclient
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/sha1"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	neturl "net/url"
+	"path"
+	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 
 	"github.com/cloudfoundry/gosteno"
 	"github.com/cloudfoundry/sonde-go/events"
 )
 
+// Version and Commit identify the nozzle build in the User-Agent of outbound
+// requests and the build_info metric. They are meant to be set at build time with
+// -ldflags "-X <package>.Version=<version> -X <package>.Commit=<sha>".
+var (
+	Version = "dev"
+	Commit  = "unknown"
+)
+
+// Connection pool settings of the client shared by all writes.
+const (
+	maxIdleConns    = 10
+	idleConnTimeout = 90 * time.Second
+)
+
 type Client struct {
+	// Updated with sync/atomic, so they are read without waiting for a post
+	// holding the lock, or counted while an envelope is parsed outside it.
+	// Kept first for 64-bit alignment on 32-bit platforms.
+	totalMessagesReceived uint64
+	totalMetricsSent      uint64
+	emptyNames            uint64
+	droppedMetrics        uint64
+
 	url                   string
 	database              string
 	user                  string
 	password              string
-	allowSelfSigned       bool
 	metricPoints          map[metricKey]metricValue
+	bufferedPoints        int
+	bufferedBytes         int
+	maxBufferBytes        int
+	bufferCapDrops        uint64
+	apiV2                 bool
+	org                   string
+	token                 string
 	prefix                string
+	internalPrefix        string
 	deployment            string
 	ip                    string
 	tagsHash              string
-	totalMessagesReceived uint64
-	totalMetricsSent      uint64
+	envelopeFieldMapping  map[string]string
+	duplicateTagPolicy    string
+	promoteCFTags         bool
+	tagNames              map[string]string
+	measurementCase       string
+	separateInternal      bool
+	sourceIDTag           bool
+	httpMetrics           bool
+	containerMetrics      bool
+	retentionPolicies     []retentionPolicy
+	precision             string
+	precisions            []measurementPrecision
+	errorBodyLogLimit     int
+	skipIdlePosts         bool
+	lineTerminator        string
+	constantField         string
+	quarantineConflicts   bool
+	maxLineLength         int
+	maxLinesPerRequest    int
+	oversizedLinesDropped uint64
+	datadogURL            string
+	datadogAPIKey         string
+	datadogPostFailures   uint64
+	userAgent             string
+	dropAfterFailedPosts  int
+	failedPosts           int
+	firstFailedPost       time.Time
+	pointsDropped         uint64
+	maxRetries            int
+	retryBudget           *RetryBudget
+	dnsRetryDelay         time.Duration
+	retryBaseDelay        time.Duration
+	retryMaxDelay         time.Duration
+	transport             *http.Transport
+	udpConn               *net.UDPConn
+	udpPayloadSize        int
+	httpClient            *http.Client
+	postRetries           uint64
+	skippedPosts          uint64
+	buildInfoSent         bool
+	indexFormat           string
+	counterShape          string
+	compactRepeated       bool
+	counterStates         map[metricKey]*counterState
+	counterFlushInterval  time.Duration
+	lastCounterFlush      time.Time
+	holdCounters          bool
+	emitRuntimeMetrics    bool
+	measurementSuffix     string
+	consumerErrors        map[string]uint64
+	maxTagsPerSeries      int
+	writeTimeout          time.Duration
+	redactedTags          map[string]bool
+	redactionMode         string
+	emptyNamePolicy       string
+	allowList             []string
+	denyList              []string
+	writeFormat           string
+	gzipWrites            bool
+	gzipLevel             int
+	acceptGzip            bool
+	deploymentEventTypes  map[string]map[events.Envelope_EventType]bool
+	tagSetReportInterval  time.Duration
+	lastTagSetReport      time.Time
+	quarantined           map[string]struct{}
+	schemaConflicts       uint64
+	counterRateInterval   time.Duration
+	silenceThreshold      time.Duration
+	lastReceived          time.Time
+	receiveRate           *rateWindow
+	jobAggregates         map[string]bool
+	jobTotals             map[jobAggregateKey]map[string]float64
+	deploymentsSeen       map[string]struct{}
+	applicationsSeen      map[string]struct{}
+	tokenExpiry           time.Time
+	configWarnings        int
+	originSampleRates     map[string]float64
+	containerShape        string
+	counterMode           string
+	fieldTypes            map[string]string
+	autoPrecision         bool
+	tagRanks              map[string]int
+	staticTags            []tag
+	sampler               *rand.Rand
+	reportConfigWarnings  bool
+	now                   func() time.Time
+	totalBytesReceived    uint64
+	receivedMark          uint64
+	sentMark              uint64
+	intervalReceived      uint64
 	log                   *gosteno.Logger
+	lock                  sync.Mutex
+	postLock              sync.Mutex
 }
 
 type metricKey struct {
@@ -37,117 +175,1676 @@ type metricKey struct {
 	tagsHash  string
 }
 
-type metricValue struct {
-	tags   []string
-	points []Point
+// isInternal reports whether the key belongs to a metric generated by the nozzle
+// itself rather than one received from the firehose.
+func (k metricKey) isInternal() bool {
+	return k.eventType == 0
+}
+
+type retentionPolicy struct {
+	pattern *regexp.Regexp
+	name    string
+}
+
+type measurementPrecision struct {
+	pattern   *regexp.Regexp
+	precision string
+}
+
+// precisionUnits maps the InfluxDB write precisions to their length in nanoseconds,
+// the unit of firehose timestamps.
+var precisionUnits = map[string]int64{
+	"ns": 1,
+	"u":  int64(time.Microsecond),
+	"ms": int64(time.Millisecond),
+	"s":  int64(time.Second),
+	"m":  int64(time.Minute),
+	"h":  int64(time.Hour),
+}
+
+// PrecisionAuto writes each post with second precision when every firehose
+// timestamp in it falls on a second, and with nanoseconds otherwise.
+const PrecisionAuto = "auto"
+
+// precisionAliases maps alternative precision names to the ones of the 1.x write API.
+var precisionAliases = map[string]string{
+	"us": "u",
+}
+
+func normalizePrecision(precision string) string {
+	if alias, ok := precisionAliases[precision]; ok {
+		return alias
+	}
+	return precision
+}
+
+// batchKey identifies the write request a series belongs to, since both the
+// retention policy and the precision are set for a whole request. Requests
+// split to respect the line limit are told apart by their chunk.
+type batchKey struct {
+	retentionPolicy string
+	precision       string
+	internal        bool
+	chunk           int
+}
+
+// tag is a tag of a series. The key and value are kept apart until the series is
+// written, as either may contain the = separating them in line protocol.
+type tag struct {
+	key   string
+	value string
+}
+
+// String formats the tag as key=value, for display.
+func (t tag) String() string {
+	return t.key + "=" + t.value
+}
+
+type metricValue struct {
+	tags      []tag
+	points    []Point
+	fieldType string
+}
+
+// Metric is a series as written to the Datadog series API.
+type Metric struct {
+	Metric string   `json:"metric"`
+	Points []Point  `json:"points"`
+	Type   string   `json:"type"`
+	Host   string   `json:"host,omitempty"`
+	Tags   []string `json:"tags,omitempty"`
+}
+
+type Point struct {
+	Timestamp int64
+	Value     float64
+	Fields    []string
+}
+
+// MarshalJSON writes the point as the [timestamp, value] pair Datadog expects.
+func (p Point) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf("[%d, %f]", p.Timestamp, p.Value)), nil
+}
+
+// sourceIDTagName is the envelope tag Loggregator v2 envelopes carry their
+// source_id in once converted to v1.
+const sourceIDTagName = "source_id"
+
+// Modes an envelope attribute can be mapped to in the envelope field mapping.
+const (
+	MappingTag   = "tag"
+	MappingField = "field"
+	MappingOmit  = "omit"
+)
+
+// EnvelopeAttributes are the envelope attributes that can be mapped to tags or fields.
+var EnvelopeAttributes = []string{"deployment", "job", "index", "ip", "origin"}
+
+// Policies for resolving an envelope tag whose key collides with a standard tag.
+const (
+	DuplicateTagFirstWins = "first"
+	DuplicateTagLastWins  = "last"
+)
+
+// Shapes counters can be written in. CounterShapeDerivative adds an integer
+// delta field and a host tag identifying the emitting instance, so the total in
+// value can be queried with non_negative_derivative per instance.
+const (
+	CounterShapeTotal      = "total"
+	CounterShapeDerivative = "derivative"
+)
+
+// Values counters can be written with. CounterModeDelta writes the increment
+// carried by each event instead of the running total.
+const (
+	CounterModeTotal = "total"
+	CounterModeDelta = "delta"
+)
+
+// Shapes container metrics can be written in. ContainerShapeFields writes one
+// container measurement per envelope, with the CPU percentage in value and the
+// memory and disk usage as integer fields.
+const (
+	ContainerShapeMeasurements = "measurements"
+	ContainerShapeFields       = "fields"
+)
+
+// Types the value field of a metric can be declared with, see SetFieldTypes.
+const (
+	FieldTypeFloat  = "float"
+	FieldTypeInt    = "int"
+	FieldTypeBool   = "bool"
+	FieldTypeString = "string"
+)
+
+// Actions taken when the buffer grows past its byte cap. BufferCapFlush posts the
+// buffer early; BufferCapDrop drops the series with the oldest points, see
+// SetMaxBufferBytes.
+const (
+	BufferCapFlush = "flush"
+	BufferCapDrop  = "drop"
+)
+
+// pointOverhead estimates the bytes a written point takes besides its name, tags
+// and extra fields: the prefix, value field, timestamp and separators.
+const pointOverhead = 48
+
+// Ways the values of sensitive tags are redacted.
+const (
+	RedactionMask = "mask"
+	RedactionHash = "hash"
+)
+
+const redactionMask = "REDACTED"
+
+// Ways of handling envelopes with an empty origin or metric name.
+// EmptyNamePlaceholder substitutes emptyNamePlaceholder for the empty parts.
+const (
+	EmptyNameKeep        = "keep"
+	EmptyNameSkip        = "skip"
+	EmptyNamePlaceholder = "placeholder"
+)
+
+const emptyNamePlaceholder = "unknown"
+
+// Casings measurement names can be written in. The metric prefix and suffix are
+// written as configured.
+const (
+	MeasurementCasePreserve = "preserve"
+	MeasurementCaseLower    = "lower"
+	MeasurementCaseUpper    = "upper"
+	MeasurementCaseSnake    = "snake"
+)
+
+// Formats the envelope index tag can be coerced to.
+const (
+	IndexFormatRaw   = "raw"
+	IndexFormatShort = "short"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// cfTagNames maps CF metadata envelope tags to the standardized tag names they are
+// promoted to.
+var cfTagNames = map[string]string{
+	"space_name":        "space",
+	"organization_name": "org",
+}
+
+var fieldTypeConflictPattern = regexp.MustCompile(`field type conflict: input field \\?"[^"\\]*\\?" on measurement \\?"([^"\\]*)\\?"`)
+
+var defaultEnvelopeFieldMapping = map[string]string{
+	"deployment": MappingTag,
+	"job":        MappingTag,
+	"index":      MappingTag,
+	"ip":         MappingTag,
+	"origin":     MappingOmit,
+}
+
+func New(url string, database string, user string, password string, allowSelfSigned bool, prefix string, deployment string, ip string, log *gosteno.Logger) *Client {
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: allowSelfSigned},
+		MaxIdleConns:    maxIdleConns,
+		IdleConnTimeout: idleConnTimeout,
+	}
+
+	return &Client{
+		transport:        transport,
+		httpClient:       &http.Client{Transport: transport},
+		url:              url,
+		database:         database,
+		user:             user,
+		password:         password,
+		metricPoints:     make(map[metricKey]metricValue),
+		deploymentsSeen:  make(map[string]struct{}),
+		applicationsSeen: make(map[string]struct{}),
+		sourceIDTag:      true,
+		quarantined:      make(map[string]struct{}),
+		consumerErrors:   make(map[string]uint64),
+		userAgent:        "influxdb-firehose-nozzle/" + Version,
+		prefix:           prefix,
+		internalPrefix:   prefix,
+		lineTerminator:   "\n",
+		deployment:       deployment,
+		ip:               ip,
+		lastReceived:     time.Now(),
+		receiveRate:      newRateWindow(time.Minute),
+		now:              time.Now,
+		log:              log,
+	}
+}
+
+// SetEnvelopeFieldMapping overrides whether envelope attributes are written as tags,
+// fields or omitted. Attributes missing from the mapping keep their default mode.
+func (c *Client) SetEnvelopeFieldMapping(mapping map[string]string) {
+	c.envelopeFieldMapping = mapping
+}
+
+// SetTagNames renames the tags written for envelope attributes, e.g. deployment
+// to bosh_deployment. Attributes missing from names keep their own name.
+func (c *Client) SetTagNames(names map[string]string) {
+	c.tagNames = names
+}
+
+// SetSeparateInternalBatch makes the client write internal metrics in a request
+// of their own, which is sent and retried even when writing firehose metrics fails.
+func (c *Client) SetSeparateInternalBatch(separate bool) {
+	c.separateInternal = separate
+}
+
+// SetInternalMetricPrefix replaces the metric prefix for metrics generated by the
+// nozzle itself. An empty prefix keeps using the regular metric prefix.
+func (c *Client) SetInternalMetricPrefix(prefix string) {
+	if prefix != "" {
+		c.internalPrefix = prefix
+	}
+}
+
+// SetPromoteCFTags enables writing CF space and org envelope tags under the
+// standardized space and org tag names.
+func (c *Client) SetPromoteCFTags(promote bool) {
+	c.promoteCFTags = promote
+}
+
+// SetSourceIDTag decides whether the source_id of envelopes converted from
+// Loggregator v2, carried in their tags, is written as a source_id tag.
+func (c *Client) SetSourceIDTag(enabled bool) {
+	c.sourceIDTag = enabled
+}
+
+// SetContainerMetrics enables writing the CPU, memory and disk usage of
+// ContainerMetric envelopes, which are dropped by default.
+func (c *Client) SetContainerMetrics(enabled bool) {
+	c.containerMetrics = enabled
+}
+
+// SetHttpMetrics enables writing the latency of HttpStartStop envelopes, one
+// point per request, which are dropped by default.
+func (c *Client) SetHttpMetrics(enabled bool) {
+	c.httpMetrics = enabled
+}
+
+// SetDuplicateTagPolicy decides whether the standard tag (first) or the envelope
+// tag (last) is kept when both use the same key.
+func (c *Client) SetDuplicateTagPolicy(policy string) {
+	c.duplicateTagPolicy = policy
+}
+
+// SetIndexFormat sets how the envelope index is written as a tag. With
+// IndexFormatShort, UUID indexes are shortened to their first eight hex digits and
+// numeric ones lose their leading zeros, so both kinds tag consistently.
+func (c *Client) SetIndexFormat(format string) {
+	c.indexFormat = format
+}
+
+// SetStaticTags adds the given tags to every series, including the internal
+// metrics, such as env=prod to tell deployments apart. They are added after
+// MaxTagsPerSeries is applied, so they are never dropped.
+func (c *Client) SetStaticTags(tags map[string]string) {
+	c.staticTags = nil
+	for key, value := range tags {
+		c.staticTags = append(c.staticTags, tag{key: key, value: value})
+	}
+	sort.Sort(byKey(c.staticTags))
+}
+
+// SetTagOrder sets the keys written first, in the given order, in every series.
+// The remaining tags follow sorted, as they are by default.
+func (c *Client) SetTagOrder(keys []string) {
+	c.tagRanks = make(map[string]int, len(keys))
+	for rank, key := range keys {
+		c.tagRanks[key] = rank
+	}
+}
+
+// SetContainerShape sets how container metrics are written, see ContainerShapeFields.
+func (c *Client) SetContainerShape(shape string) {
+	c.containerShape = shape
+}
+
+// SetCounterMode sets the value counters are written with, see CounterModeDelta.
+func (c *Client) SetCounterMode(mode string) {
+	c.counterMode = mode
+}
+
+// SetFieldTypes declares the type the value field of the named metrics is written
+// with, so a measurement keeps one type however its values look. Integers are
+// rounded, and booleans are true for any value but zero. Metrics not declared
+// are written as floats.
+func (c *Client) SetFieldTypes(types map[string]string) {
+	c.fieldTypes = types
+}
+
+// SetCounterShape sets how counter events are written, see CounterShapeDerivative.
+func (c *Client) SetCounterShape(shape string) {
+	c.counterShape = shape
+}
+
+// SetResetSafeCounters makes the client keep the last total of every counter
+// series across posts and carry it over when the emitting instance restarts and
+// its total starts over, so the written totals never go backwards.
+func (c *Client) SetResetSafeCounters(enabled bool) {
+	if enabled {
+		c.counterStates = make(map[metricKey]*counterState)
+	} else {
+		c.counterStates = nil
+	}
+}
+
+// SetCompactRepeatedValues makes the client keep only the first and the last
+// point of a run of identical values buffered for a series.
+func (c *Client) SetCompactRepeatedValues(compact bool) {
+	c.compactRepeated = compact
+}
+
+// SetCounterFlushInterval makes counters flush at most once per interval, holding
+// them in the buffer across the posts in between. Value metrics are unaffected.
+func (c *Client) SetCounterFlushInterval(interval time.Duration) {
+	c.counterFlushInterval = interval
+}
+
+// SetEmitRuntimeMetrics makes the client report metrics about the nozzle process
+// itself on every post, such as its goroutine count, receive rate, retries and
+// drops. Metrics enabled by their own setting, such as firehoseSilent, are
+// reported either way.
+func (c *Client) SetEmitRuntimeMetrics(emit bool) {
+	c.emitRuntimeMetrics = emit
+}
+
+// SetMeasurementSuffix sets a suffix, such as _total, appended to the measurement
+// name of every firehose metric.
+func (c *Client) SetMeasurementSuffix(suffix string) {
+	c.measurementSuffix = suffix
+}
+
+// SetMaxTagsPerSeries bounds cardinality by keeping at most max tags per series,
+// the first ones in sorted order. A max of 0 keeps every tag.
+func (c *Client) SetMaxTagsPerSeries(max int) {
+	c.maxTagsPerSeries = max
+}
+
+// SetWriteTimeout bounds how long a whole post, retries included, may take.
+func (c *Client) SetWriteTimeout(timeout time.Duration) {
+	c.writeTimeout = timeout
+}
+
+// SetRedactedTags makes the client mask, or with RedactionHash replace by a
+// hash, the values of the given tag keys before they are written. Keys are the
+// names tags are written with, so a renamed or promoted tag is listed by its
+// new name.
+func (c *Client) SetRedactedTags(keys []string, mode string) {
+	c.redactedTags = make(map[string]bool, len(keys))
+	for _, key := range keys {
+		c.redactedTags[key] = true
+	}
+	c.redactionMode = mode
+}
+
+// SetMeasurementCase sets the casing firehose measurement names are written in.
+func (c *Client) SetMeasurementCase(policy string) {
+	c.measurementCase = policy
+}
+
+// SetEmptyNamePolicy sets how envelopes with an empty origin or metric name are
+// handled. They are counted in emptyMetricNames whatever the policy.
+func (c *Client) SetEmptyNamePolicy(policy string) {
+	c.emptyNamePolicy = policy
+}
+
+// SetWriteFormat selects the format batches are written in, WriteFormatLine by
+// default.
+func (c *Client) SetWriteFormat(format string) {
+	c.writeFormat = format
+}
+
+// SetAcceptGzip makes the client ask for gzipped responses with an explicit
+// Accept-Encoding header on every write and decode them itself, so large error
+// bodies cost less to transfer.
+func (c *Client) SetAcceptGzip(enabled bool) {
+	c.acceptGzip = enabled
+}
+
+// SetGzip makes the client gzip the body of every write with the given
+// compression level. Any level compress/gzip accepts is valid: gzip.BestSpeed
+// to gzip.BestCompression, gzip.DefaultCompression, gzip.NoCompression, which
+// only wraps the body in the gzip format, and gzip.HuffmanOnly.
+func (c *Client) SetGzip(enabled bool, level int) error {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return fmt.Errorf("Invalid gzip compression level %d", level)
+	}
+	c.gzipWrites = enabled
+	c.gzipLevel = level
+	return nil
+}
+
+// SetDeploymentEventTypes limits the event types forwarded from the given
+// deployments, e.g. {"noisy": ["ValueMetric"]} drops the counters of noisy.
+// Deployments which aren't listed forward every event type.
+func (c *Client) SetDeploymentEventTypes(deploymentEventTypes map[string][]string) error {
+	c.deploymentEventTypes = make(map[string]map[events.Envelope_EventType]bool, len(deploymentEventTypes))
+	for deployment, eventTypes := range deploymentEventTypes {
+		allowed := make(map[events.Envelope_EventType]bool, len(eventTypes))
+		for _, eventType := range eventTypes {
+			value, ok := events.Envelope_EventType_value[eventType]
+			if !ok {
+				return fmt.Errorf("Unknown event type %s for deployment %s", eventType, deployment)
+			}
+			allowed[events.Envelope_EventType(value)] = true
+		}
+		c.deploymentEventTypes[deployment] = allowed
+	}
+	return nil
+}
+
+// SetTagSetReportInterval makes the client report, at most once per interval, the
+// number of distinct tag sets buffered for every measurement as distinctTagSets,
+// tagged with the measurement, to find which one drives cardinality.
+func (c *Client) SetTagSetReportInterval(interval time.Duration) {
+	c.tagSetReportInterval = interval
+}
+
+// SetRetentionPolicies routes metrics whose name matches one of the regular
+// expression keys to the retention policy it maps to.
+func (c *Client) SetRetentionPolicies(policies map[string]string) error {
+	patterns := make([]string, 0, len(policies))
+	for pattern := range policies {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	c.retentionPolicies = nil
+	for _, pattern := range patterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("Invalid retention policy pattern %s: %s", pattern, err)
+		}
+		c.retentionPolicies = append(c.retentionPolicies, retentionPolicy{pattern: compiled, name: policies[pattern]})
+	}
+	return nil
+}
+
+// SetPrecision sets the timestamp precision firehose metrics are written with.
+// Metrics matching one of the patterns given to SetMeasurementPrecisions use that
+// precision instead. An empty precision writes nanoseconds, InfluxDB's default.
+func (c *Client) SetPrecision(precision string) error {
+	precision = normalizePrecision(precision)
+	c.autoPrecision = precision == PrecisionAuto
+	if c.autoPrecision {
+		c.precision = ""
+		return nil
+	}
+	if _, ok := precisionUnits[precision]; precision != "" && !ok {
+		return fmt.Errorf("Invalid precision %s", precision)
+	}
+	if precision == "ns" {
+		// Nanoseconds are InfluxDB's default, leave the write URL unchanged.
+		precision = ""
+	}
+	c.precision = precision
+	return nil
+}
+
+// SetMeasurementPrecisions sets the timestamp precision of the metrics whose name
+// matches a pattern. Patterns are tried in sorted order.
+func (c *Client) SetMeasurementPrecisions(precisions map[string]string) error {
+	patterns := make([]string, 0, len(precisions))
+	for pattern := range precisions {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	c.precisions = nil
+	for _, pattern := range patterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("Invalid precision pattern %s: %s", pattern, err)
+		}
+		precision := normalizePrecision(precisions[pattern])
+		if _, ok := precisionUnits[precision]; !ok {
+			return fmt.Errorf("Invalid precision %s for pattern %s", precisions[pattern], pattern)
+		}
+		c.precisions = append(c.precisions, measurementPrecision{pattern: compiled, precision: precision})
+	}
+	return nil
+}
+
+// SetErrorBodyLogLimit caps how many bytes of an InfluxDB error response body are
+// logged and included in the returned error. Zero means no limit.
+func (c *Client) SetErrorBodyLogLimit(limit int) {
+	c.errorBodyLogLimit = limit
+}
+
+// SetSkipIdlePosts makes PostMetrics skip the write when no firehose metrics have
+// been added since the last post. Buffered internal metrics are kept for the next post.
+func (c *Client) SetSkipIdlePosts(skip bool) {
+	c.skipIdlePosts = skip
+}
+
+// SetLineTerminator replaces the "\n" written after every line, for example with
+// "\r\n" for gateways that require CRLF line endings.
+func (c *Client) SetLineTerminator(terminator string) {
+	if terminator != "" {
+		c.lineTerminator = terminator
+	}
+}
+
+// SetConstantField adds the given field to every point written. Numeric values are
+// written as float fields, anything else as a string field.
+func (c *Client) SetConstantField(key string, value string) {
+	if key == "" {
+		c.constantField = ""
+		return
+	}
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		c.constantField = key + "=" + value
+		return
+	}
+	c.constantField = formatStringField(key, value)
+}
+
+// SetQuarantineConflicts makes the client stop sending measurements which InfluxDB
+// rejected with a field type conflict, instead of failing the post.
+func (c *Client) SetQuarantineConflicts(quarantine bool) {
+	c.quarantineConflicts = quarantine
+}
+
+// SetMaxLinesPerRequest splits every post into sequential write requests of
+// about limit lines. A series is never split, so a request holding a series with
+// many points may exceed the limit. Zero, the default, disables splitting.
+func (c *Client) SetMaxLinesPerRequest(limit int) {
+	c.maxLinesPerRequest = limit
+}
+
+// SetMaxBufferBytes caps the estimated size of the buffered firehose points at
+// limit bytes. Past the cap, the series with the oldest points are dropped until
+// the buffer fits again. A limit of 0 disables the cap.
+func (c *Client) SetMaxBufferBytes(limit int) {
+	c.maxBufferBytes = limit
+}
+
+// SetMaxLineLength makes the client drop, instead of sending, any line longer
+// than limit bytes. A limit of 0 disables the check.
+func (c *Client) SetMaxLineLength(limit int) {
+	c.maxLineLength = limit
+}
+
+// SetUserAgent overrides the User-Agent header sent with every write.
+func (c *Client) SetUserAgent(userAgent string) {
+	if userAgent != "" {
+		c.userAgent = userAgent
+	}
+}
+
+// SetDropAfterFailedPosts makes the client discard its buffered points after the
+// given number of consecutive failed posts, instead of holding on to them until
+// InfluxDB recovers. A value of 0 keeps the points forever.
+func (c *Client) SetDropAfterFailedPosts(posts int) {
+	c.dropAfterFailedPosts = posts
+}
+
+// SetRetries makes the client retry writes failing with a network error or a 5xx
+// response up to maxRetries times. When budget is not nil every retry has to be
+// taken from it, and is skipped once it is exhausted.
+func (c *Client) SetRetries(maxRetries int, budget *RetryBudget) {
+	c.maxRetries = maxRetries
+	c.retryBudget = budget
+}
+
+// SetAPIV2 makes the client write to the InfluxDB 2.x API of org, authenticating
+// with token. The database is used as the bucket, followed by /<retention policy>
+// when one applies, matching the 1.x compatibility bucket names.
+func (c *Client) SetAPIV2(org string, token string) {
+	c.apiV2 = true
+	c.org = org
+	c.token = token
+}
+
+// SetRetryBackoff makes the client wait before every retry, starting with base
+// and doubling the delay after every attempt up to max.
+func (c *Client) SetRetryBackoff(base time.Duration, max time.Duration) {
+	c.retryBaseDelay = base
+	c.retryMaxDelay = max
+}
+
+// SetDNSRetryDelay sets how long the client waits before retrying a write whose
+// InfluxDB hostname failed to resolve, giving a DNS blip time to clear.
+func (c *Client) SetDNSRetryDelay(delay time.Duration) {
+	c.dnsRetryDelay = delay
+}
+
+// SetTLSServerName overrides the server name InfluxDB certificates are verified
+// against and sent as SNI, for connecting to InfluxDB by IP.
+func (c *Client) SetTLSServerName(name string) {
+	c.transport.TLSClientConfig.ServerName = name
+}
+
+// SetRootCAs sets the certificate authorities InfluxDB certificates are verified
+// with, instead of the system ones.
+func (c *Client) SetRootCAs(pool *x509.CertPool) {
+	c.transport.TLSClientConfig.RootCAs = pool
+}
+
+// SetDial replaces the function used to open connections to InfluxDB.
+func (c *Client) SetDial(dial func(ctx context.Context, network, address string) (net.Conn, error)) {
+	c.transport.DialContext = dial
+}
+
+// SetCounterRateInterval enables emitting a <name>.rate series for every counter,
+// computed as the counter delta divided by the given interval. Zero disables it.
+func (c *Client) SetCounterRateInterval(interval time.Duration) {
+	c.counterRateInterval = interval
+}
+
+// SetSilenceThreshold enables the firehoseSilent metric, which reports 1 when no
+// envelopes have been received for at least the given duration.
+func (c *Client) SetSilenceThreshold(threshold time.Duration) {
+	c.silenceThreshold = threshold
+}
+
+// SetReceiveRateWindow sets the sliding window over which the envelopeReceiveRate
+// gauge averages the number of envelopes received per second. Defaults to a minute.
+func (c *Client) SetReceiveRateWindow(window time.Duration) {
+	c.receiveRate = newRateWindow(window)
+}
+
+// SetTokenExpiry enables the tokenExpirySeconds metric, reporting how many seconds
+// remain before the UAA token used for the firehose expires.
+func (c *Client) SetTokenExpiry(expiry time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.tokenExpiry = expiry
+}
+
+// SetMetricFilter keeps only the metrics matching a pattern of allow, when it is
+// not empty, and drops those matching a pattern of deny. Patterns are globs as
+// accepted by path.Match, matched against both the origin and the metric name
+// without the prefix, such as gorouter or rep.Capacity*.
+func (c *Client) SetMetricFilter(allow []string, deny []string) {
+	c.allowList = allow
+	c.denyList = deny
+}
+
+// SetOriginSampleRates keeps only the given fraction, between 0 and 1, of the
+// envelopes from each origin, choosing them with random. Origins without a rate
+// are kept in full.
+func (c *Client) SetOriginSampleRates(rates map[string]float64, random *rand.Rand) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.originSampleRates = rates
+	c.sampler = random
+}
+
+// SetConfigWarnings enables the configWarnings metric, reporting how many
+// non-fatal problems were found in the nozzle config.
+func (c *Client) SetConfigWarnings(warnings int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.configWarnings = warnings
+	c.reportConfigWarnings = true
+}
+
+// SetClock replaces the time source used by the client and restarts silence tracking.
+func (c *Client) SetClock(now func() time.Time) {
+	c.now = now
+	c.lastReceived = now()
+}
+
+func (c *Client) AlertSlowConsumerError() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.addInternalMetric("slowConsumerAlert", 1)
+}
+
+// RecordConsumerError counts an error read from the firehose under its category.
+// Every category seen is reported as firehoseErrors.<category>.
+func (c *Client) RecordConsumerError(category string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.consumerErrors[category]++
+}
+
+// RecordShutdown reports that the nozzle is stopping, as a shutdown internal metric
+// tagged with the reason. It is sent with the next post.
+func (c *Client) RecordShutdown(reason string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.addTaggedInternalMetric("shutdown", 1, tag{key: "reason", value: reason})
+}
+
+// RecordFlushDrift reports how late the current flush started compared to when it
+// was scheduled. It is sent as the flushDriftMs internal metric when runtime
+// metrics are enabled.
+func (c *Client) RecordFlushDrift(drift time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.emitRuntimeMetrics {
+		c.addInternalMetric("flushDriftMs", float64(drift)/float64(time.Millisecond))
+	}
+}
+
+// AddMetric buffers the points of an envelope. The envelope is parsed without
+// holding the lock, which is only taken to count it and to buffer its points, so
+// concurrent callers share little more than the map updates.
+func (c *Client) AddMetric(envelope *events.Envelope) {
+	if envelope == nil || !c.receive(envelope) {
+		return
+	}
+	if envelope.GetEventType() == events.Envelope_ContainerMetric {
+		c.addContainerMetric(envelope)
+		return
+	}
+
+	origin, metricName, ok := c.checkName(envelope.GetOrigin(), getMetricName(envelope))
+	if !ok || c.filtered(origin, metricName) {
+		return
+	}
+
+	tags := c.parseTags(envelope)
+	fields := parseFields(envelope, c.envelopeFieldMapping)
+	if c.counterShape == CounterShapeDerivative && envelope.GetEventType() == events.Envelope_CounterEvent {
+		tags = c.appendTagIfNotEmpty(tags, "host", counterInstance(envelope))
+		fields = append(fields, fmt.Sprintf("delta=%di", envelope.GetCounterEvent().GetDelta()))
+	}
+	if envelope.GetEventType() == events.Envelope_HttpStartStop {
+		tags = c.appendHttpTags(tags, envelope.GetHttpStartStop())
+	}
+	c.redactTags(tags)
+	tags = c.limitTags(tags)
+	c.sortTags(tags)
+	key := metricKey{
+		eventType: envelope.GetEventType(),
+		name:      origin + "." + metricName,
+		tagsHash:  hashTags(tags),
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	defer c.enforceBufferCap()
+
+	if envelope.GetEventType() == events.Envelope_HttpStartStop {
+		c.recordApplication(httpApplicationID(envelope.GetHttpStartStop()))
+	}
+	value := getValue(envelope, c.counterMode)
+	if c.counterStates != nil && key.eventType == events.Envelope_CounterEvent && c.counterMode != CounterModeDelta {
+		value = float64(c.continuousTotal(key, envelope.GetCounterEvent().GetTotal()))
+	}
+
+	c.addPoint(key, tags, Point{
+		Timestamp: envelope.GetTimestamp(),
+		Value:     value,
+		Fields:    fields,
+	})
+	c.aggregateJob(envelope, key.name, value)
+
+	if c.counterRateInterval > 0 && envelope.GetEventType() == events.Envelope_CounterEvent {
+		c.addCounterRate(envelope, key, tags)
+	}
+}
+
+// receive counts an envelope as received, reporting whether it is an event type
+// buffered for its deployment that survives sampling.
+func (c *Client) receive(envelope *events.Envelope) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	atomic.AddUint64(&c.totalMessagesReceived, 1)
+	c.totalBytesReceived += uint64(envelope.Size())
+	c.lastReceived = c.now()
+	c.receiveRate.add(c.lastReceived)
+	if envelope.GetDeployment() != "" {
+		c.deploymentsSeen[envelope.GetDeployment()] = struct{}{}
+	}
+	switch envelope.GetEventType() {
+	case events.Envelope_ValueMetric, events.Envelope_CounterEvent:
+	case events.Envelope_ContainerMetric:
+		if !c.containerMetrics {
+			return false
+		}
+	case events.Envelope_HttpStartStop:
+		if !c.httpMetrics {
+			return false
+		}
+	default:
+		return false
+	}
+	if allowed, ok := c.deploymentEventTypes[envelope.GetDeployment()]; ok && !allowed[envelope.GetEventType()] {
+		return false
+	}
+	if rate, ok := c.originSampleRates[envelope.GetOrigin()]; ok && c.sampler.Float64() >= rate {
+		return false
+	}
+	return true
+}
+
+// filtered reports whether a metric is dropped by the allow and deny lists,
+// counting it towards droppedMetrics when it is.
+func (c *Client) filtered(origin string, metricName string) bool {
+	name := origin + "." + metricName
+	if (len(c.allowList) > 0 && !matchesAny(c.allowList, origin, name)) || matchesAny(c.denyList, origin, name) {
+		atomic.AddUint64(&c.droppedMetrics, 1)
+		return true
+	}
+	return false
+}
+
+func matchesAny(patterns []string, names ...string) bool {
+	for _, pattern := range patterns {
+		for _, name := range names {
+			if matched, _ := path.Match(pattern, name); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkName applies the empty name policy to the parts of a measurement name,
+// reporting whether the metric is kept.
+func (c *Client) checkName(origin string, metricName string) (string, string, bool) {
+	if origin != "" && metricName != "" {
+		return origin, metricName, true
+	}
+
+	atomic.AddUint64(&c.emptyNames, 1)
+	switch c.emptyNamePolicy {
+	case EmptyNameSkip:
+		return origin, metricName, false
+	case EmptyNamePlaceholder:
+		return orPlaceholder(origin), orPlaceholder(metricName), true
+	}
+	return origin, metricName, true
+}
+
+// appendHttpTags tags the latency of a request with its method, status code and,
+// when known, the application that served it.
+func (c *Client) appendHttpTags(tags []tag, httpStartStop *events.HttpStartStop) []tag {
+	tags = c.appendTagIfNotEmpty(tags, "method", httpStartStop.GetMethod().String())
+	tags = c.appendTagIfNotEmpty(tags, "status_code", strconv.Itoa(int(httpStartStop.GetStatusCode())))
+	tags = c.appendTagIfNotEmpty(tags, "application_id", httpApplicationID(httpStartStop))
+	return tags
+}
+
+// httpApplicationID returns the application which served a request, or an empty
+// string when it is unknown.
+func httpApplicationID(httpStartStop *events.HttpStartStop) string {
+	if applicationID := httpStartStop.GetApplicationId(); applicationID != nil {
+		return formatUUID(applicationID)
+	}
+	return ""
+}
+
+// recordApplication counts an application towards distinctApplications.
+func (c *Client) recordApplication(applicationID string) {
+	if applicationID != "" {
+		c.applicationsSeen[applicationID] = struct{}{}
+	}
+}
+
+// formatUUID renders a UUID in its canonical form; dropsonde stores the bytes
+// of the UUID in little-endian order across its two halves.
+func formatUUID(uuid *events.UUID) string {
+	var b [16]byte
+	binary.LittleEndian.PutUint64(b[:8], uuid.GetLow())
+	binary.LittleEndian.PutUint64(b[8:], uuid.GetHigh())
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// addContainerMetric writes the CPU, memory and disk usage of a container as
+// separate series tagged with the application and instance.
+func (c *Client) addContainerMetric(envelope *events.Envelope) {
+	origin, _, ok := c.checkName(envelope.GetOrigin(), "container")
+	if !ok {
+		return
+	}
+
+	metric := envelope.GetContainerMetric()
+	tags := c.parseTags(envelope)
+	tags = c.appendTagIfNotEmpty(tags, "application_id", metric.GetApplicationId())
+	tags = c.appendTagIfNotEmpty(tags, "instance_index", strconv.Itoa(int(metric.GetInstanceIndex())))
+	c.redactTags(tags)
+	tags = c.limitTags(tags)
+	c.sortTags(tags)
+	tagsHash := hashTags(tags)
+	fields := parseFields(envelope, c.envelopeFieldMapping)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	defer c.enforceBufferCap()
+
+	c.recordApplication(metric.GetApplicationId())
+
+	if c.containerShape == ContainerShapeFields {
+		if c.filtered(origin, "container") {
+			return
+		}
+		key := metricKey{
+			eventType: events.Envelope_ContainerMetric,
+			name:      origin + ".container",
+			tagsHash:  tagsHash,
+		}
+		c.addPoint(key, tags, Point{
+			Timestamp: envelope.GetTimestamp(),
+			Value:     metric.GetCpuPercentage(),
+			Fields: append([]string{
+				fmt.Sprintf("memory_bytes=%di", metric.GetMemoryBytes()),
+				fmt.Sprintf("disk_bytes=%di", metric.GetDiskBytes()),
+			}, fields...),
+		})
+		return
+	}
+
+	values := []struct {
+		name  string
+		value float64
+	}{
+		{"cpu_percentage", metric.GetCpuPercentage()},
+		{"memory_bytes", float64(metric.GetMemoryBytes())},
+		{"disk_bytes", float64(metric.GetDiskBytes())},
+	}
+	for _, v := range values {
+		if c.filtered(origin, v.name) {
+			continue
+		}
+		key := metricKey{
+			eventType: events.Envelope_ContainerMetric,
+			name:      origin + "." + v.name,
+			tagsHash:  tagsHash,
+		}
+		c.addPoint(key, tags, Point{
+			Timestamp: envelope.GetTimestamp(),
+			Value:     v.value,
+			Fields:    fields,
+		})
+	}
+}
+
+func (c *Client) addPoint(key metricKey, tags []tag, point Point) {
+	mVal := c.metricPoints[key]
+	mVal.tags = tags
+	if n := len(mVal.points); c.compactRepeated && n >= 2 && samePointValues(mVal.points[n-2], point) && samePointValues(mVal.points[n-1], point) {
+		mVal.points[n-1] = point
+	} else {
+		mVal.points = append(mVal.points, point)
+		c.bufferedPoints++
+		c.bufferedBytes += pointBytes(key, tags, point)
+	}
+
+	c.metricPoints[key] = mVal
+}
+
+// counterState tracks a counter series across posts.
+type counterState struct {
+	lastTotal uint64
+	offset    uint64
+}
+
+// continuousTotal returns total offset by the totals reached before every reset
+// of the series seen so far.
+func (c *Client) continuousTotal(key metricKey, total uint64) uint64 {
+	state, ok := c.counterStates[key]
+	if !ok {
+		state = &counterState{}
+		c.counterStates[key] = state
+	}
+	if total < state.lastTotal {
+		state.offset += state.lastTotal
+	}
+	state.lastTotal = total
+	return total + state.offset
+}
+
+func samePointValues(a, b Point) bool {
+	if a.Value != b.Value || len(a.Fields) != len(b.Fields) {
+		return false
+	}
+	for i := range a.Fields {
+		if a.Fields[i] != b.Fields[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Client) addCounterRate(envelope *events.Envelope, counterKey metricKey, tags []tag) {
+	key := counterKey
+	key.name += ".rate"
+
+	point := Point{
+		Timestamp: envelope.GetTimestamp(),
+		Value:     float64(envelope.GetCounterEvent().GetDelta()) / c.counterRateInterval.Seconds(),
+	}
+	mVal := c.metricPoints[key]
+	mVal.tags = tags
+	mVal.points = append(mVal.points, point)
+	c.bufferedPoints++
+	c.bufferedBytes += pointBytes(key, tags, point)
+
+	c.metricPoints[key] = mVal
+}
+
+// PostMetrics writes the buffered series. The buffer is only locked while the
+// series are taken out of it and while unsent ones are put back, so envelopes
+// keep being added while the requests are in flight.
+func (c *Client) PostMetrics() error {
+	c.postLock.Lock()
+	defer c.postLock.Unlock()
+
+	c.lock.Lock()
+	if c.skipIdlePosts && !c.containsFirehoseMetrics() {
+		c.log.Debug("Skipping post, no metrics received since the last post")
+		c.skippedPosts++
+		c.lock.Unlock()
+		return nil
+	}
+
+	c.holdCounters = c.counterFlushInterval > 0 && c.now().Sub(c.lastCounterFlush) < c.counterFlushInterval
+	c.addJobTotals()
+	c.populateInternalMetrics()
+	points := c.takePoints()
+	deployments, applications := c.deploymentsSeen, c.applicationsSeen
+	c.deploymentsSeen = make(map[string]struct{})
+	c.applicationsSeen = make(map[string]struct{})
+	c.lock.Unlock()
+
+	c.log.Infof("Posting %d metrics", len(points))
+
+	batches, metricsCount := c.formatMetrics(points)
+
+	ctx := context.Background()
+	if c.writeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.writeTimeout)
+		defer cancel()
+	}
+
+	err := c.sendBatches(ctx, c.httpClient, batches, points)
+	releaseBatches(batches)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err != nil {
+		c.restoreUnsent(points, batches)
+		for deployment := range deployments {
+			c.deploymentsSeen[deployment] = struct{}{}
+		}
+		for applicationID := range applications {
+			c.applicationsSeen[applicationID] = struct{}{}
+		}
+		if c.failedPosts == 0 {
+			c.firstFailedPost = c.now()
+		}
+		c.failedPosts++
+		if c.dropAfterFailedPosts > 0 && c.failedPosts >= c.dropAfterFailedPosts {
+			c.dropBufferedPoints()
+		}
+		return err
+	}
+
+	c.failedPosts = 0
+	c.buildInfoSent = true
+	atomic.AddUint64(&c.totalMetricsSent, metricsCount)
+	c.oversizedLinesDropped += droppedLines(batches)
+	if !c.holdCounters {
+		c.lastCounterFlush = c.now()
+	}
+
+	return nil
+}
+
+// takePoints moves the series due in this post out of the buffer, leaving the
+// held counters behind.
+func (c *Client) takePoints() map[metricKey]metricValue {
+	points := c.metricPoints
+	c.metricPoints = make(map[metricKey]metricValue)
+	c.bufferedPoints = 0
+	c.bufferedBytes = 0
+	for key, mVal := range points {
+		if c.isHeld(key) {
+			delete(points, key)
+			c.metricPoints[key] = mVal
+			c.bufferedPoints += len(mVal.points)
+			c.bufferedBytes += seriesBytes(key, mVal)
+		}
+	}
+	return points
+}
+
+// BufferedPoints returns the number of firehose points waiting for the next post.
+func (c *Client) BufferedPoints() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.bufferedPoints
+}
+
+// BufferedBytes returns the estimated size of the firehose points waiting for the
+// next post, once written.
+func (c *Client) BufferedBytes() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.bufferedBytes
+}
+
+// PendingMetrics returns the number of distinct metrics waiting for the next post.
+func (c *Client) PendingMetrics() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.metricPoints)
+}
+
+// TotalMessagesReceived returns the number of envelopes received from the firehose.
+func (c *Client) TotalMessagesReceived() uint64 {
+	return atomic.LoadUint64(&c.totalMessagesReceived)
+}
+
+// TotalMetricsSent returns the number of metrics successfully posted.
+func (c *Client) TotalMetricsSent() uint64 {
+	return atomic.LoadUint64(&c.totalMetricsSent)
+}
+
+// internalBatchKey returns the batch internal metrics are written in.
+func (c *Client) internalBatchKey() batchKey {
+	return batchKey{precision: c.precision, internal: c.separateInternal}
+}
+
+// isHeld reports whether a buffered series has to wait for a later post.
+func (c *Client) isHeld(key metricKey) bool {
+	return c.holdCounters && key.eventType == events.Envelope_CounterEvent
+}
+
+func (c *Client) sendBatches(ctx context.Context, httpClient *http.Client, batches map[batchKey]*batch, points map[metricKey]metricValue) error {
+	var firstErr error
+	for key, b := range batches {
+		var err error
+		if c.udpConn != nil {
+			err = c.writeUDP(b)
+		} else {
+			err = c.postBatch(ctx, httpClient, c.seriesURL(key), b)
+		}
+		b.sent = err == nil
+		if err != nil && !c.separateInternal {
+			return err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+
+	if c.datadogURL != "" {
+		if err := c.postDatadog(ctx, httpClient, points); err != nil {
+			c.datadogPostFailures++
+			c.log.Errorf("Can't write to Datadog: %s", err)
+		}
+	}
+	return nil
+}
+
+// restoreUnsent puts the series a failed post didn't write back in the buffer,
+// ahead of the points added while it was in flight, so only the unsent points
+// are kept for the next post. The datadog sink writes the same series, so all
+// of them are put back while it is on.
+func (c *Client) restoreUnsent(points map[metricKey]metricValue, batches map[batchKey]*batch) {
+	if c.datadogURL == "" {
+		for _, b := range batches {
+			if !b.sent {
+				continue
+			}
+			for _, key := range b.keys {
+				delete(points, key)
+			}
+		}
+	}
+	for key, mVal := range points {
+		newer, ok := c.metricPoints[key]
+		if key.isInternal() {
+			if !ok {
+				c.metricPoints[key] = mVal
+			}
+			continue
+		}
+		c.bufferedPoints += len(mVal.points)
+		c.bufferedBytes += seriesBytes(key, mVal)
+		if ok {
+			mVal.points = append(mVal.points, newer.points...)
+		}
+		c.metricPoints[key] = mVal
+	}
+}
+
+func (c *Client) dropBufferedPoints() {
+	var dropped uint64
+	for key, mVal := range c.metricPoints {
+		if !key.isInternal() {
+			dropped += uint64(len(mVal.points))
+		}
+	}
+	c.log.Warnf("Dropping %d buffered points after %d failed posts", dropped, c.failedPosts)
+
+	c.pointsDropped += dropped
+	c.failedPosts = 0
+	c.metricPoints = make(map[metricKey]metricValue)
+	c.bufferedPoints = 0
+	c.bufferedBytes = 0
+	c.deploymentsSeen = make(map[string]struct{})
+	c.applicationsSeen = make(map[string]struct{})
+}
+
+// enforceBufferCap drops the series with the oldest points until the buffered
+// firehose points fit in maxBufferBytes again.
+func (c *Client) enforceBufferCap() {
+	for c.maxBufferBytes > 0 && c.bufferedBytes > c.maxBufferBytes {
+		var oldest metricKey
+		found := false
+		for key, mVal := range c.metricPoints {
+			if key.isInternal() || len(mVal.points) == 0 {
+				continue
+			}
+			if !found || mVal.points[0].Timestamp < c.metricPoints[oldest].points[0].Timestamp {
+				oldest, found = key, true
+			}
+		}
+		if !found {
+			return
+		}
+
+		mVal := c.metricPoints[oldest]
+		c.bufferCapDrops += uint64(len(mVal.points))
+		c.bufferedPoints -= len(mVal.points)
+		c.bufferedBytes -= seriesBytes(oldest, mVal)
+		delete(c.metricPoints, oldest)
+	}
+}
+
+// pointBytes estimates the size of a point once written as a line.
+func pointBytes(key metricKey, tags []tag, point Point) int {
+	size := len(key.name) + pointOverhead
+	for _, t := range tags {
+		size += len(t.key) + len(t.value) + 2
+	}
+	for _, field := range point.Fields {
+		size += len(field) + 1
+	}
+	return size
+}
+
+func seriesBytes(key metricKey, mVal metricValue) int {
+	var size int
+	for _, point := range mVal.points {
+		size += pointBytes(key, mVal.tags, point)
+	}
+	return size
+}
+
+// PostSummary describes a single write request. It is logged as JSON after every post.
+type PostSummary struct {
+	Series          int     `json:"series"`
+	Points          int     `json:"points"`
+	Bytes           int     `json:"bytes"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	Status          string  `json:"status"`
+}
+
+func (c *Client) postBatch(ctx context.Context, httpClient *http.Client, url string, b *batch) error {
+	retryable, err := c.writeBatch(ctx, httpClient, url, b)
+	for attempt := 0; err != nil && retryable && attempt < c.maxRetries; attempt++ {
+		if ctx.Err() != nil {
+			break
+		}
+		if c.retryBudget != nil && !c.retryBudget.Take() {
+			c.log.Warnf("Retry budget exhausted, not retrying failed write: %s", err)
+			break
+		}
+		delay := c.retryDelay(attempt)
+		if isDNSError(err) {
+			if c.dnsRetryDelay > delay {
+				delay = c.dnsRetryDelay
+			}
+			c.log.Warnf("Can't resolve the InfluxDB host, retrying in %s: %s", delay, err)
+			httpClient.CloseIdleConnections()
+		}
+		if !sleepContext(ctx, delay) {
+			break
+		}
+		c.postRetries++
+		retryable, err = c.writeBatch(ctx, httpClient, url, b)
+	}
+	return err
+}
+
+// retryDelay returns the backoff before retry number attempt, counted from zero.
+func (c *Client) retryDelay(attempt int) time.Duration {
+	delay := c.retryBaseDelay
+	for i := 0; i < attempt && (c.retryMaxDelay <= 0 || delay < c.retryMaxDelay); i++ {
+		delay *= 2
+	}
+	if c.retryMaxDelay > 0 && delay > c.retryMaxDelay {
+		delay = c.retryMaxDelay
+	}
+	return delay
+}
+
+func isDNSError(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr)
+}
+
+// sleepContext waits for d, returning false if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// writeBatch makes a single write request, reporting whether a failure is worth
+// retrying.
+func (c *Client) writeBatch(ctx context.Context, httpClient *http.Client, url string, b *batch) (bool, error) {
+	summary := PostSummary{
+		Series: b.series,
+		Points: b.points,
+		Bytes:  b.buffer.Len(),
+	}
+	start := time.Now()
+	defer func() {
+		summary.DurationSeconds = time.Since(start).Seconds()
+		c.logPostSummary(summary)
+	}()
+
+	req, err := c.newPostRequest(ctx, url, b.contentType, b.encoding, bytes.NewReader(b.buffer.Bytes()))
+	if err != nil {
+		summary.Status = err.Error()
+		return false, err
+	}
+	b.attachBody(req)
+	if c.apiV2 {
+		req.Header.Set("Authorization", "Token "+c.token)
+	} else if c.user != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		summary.Status = err.Error()
+		return true, err
+	}
+
+	defer resp.Body.Close()
+	summary.Status = resp.Status
+	if resp.StatusCode >= 300 || resp.StatusCode < 200 {
+		errBody, err := readResponseBody(resp)
+		if err != nil {
+			return false, fmt.Errorf("Can't read response body: %s", resp.Status)
+		}
+		if conflicts := fieldTypeConflicts(errBody); len(conflicts) > 0 {
+			c.schemaConflicts += uint64(len(conflicts))
+			for _, measurement := range conflicts {
+				c.log.Errorf("InfluxDB rejected measurement %s with a field type conflict", measurement)
+				if c.quarantineConflicts {
+					c.log.Warnf("Quarantining measurement %s, it will no longer be sent", measurement)
+					c.quarantined[measurement] = struct{}{}
+				}
+			}
+			if c.quarantineConflicts {
+				return false, nil
+			}
+		}
+		if c.errorBodyLogLimit > 0 && len(errBody) > c.errorBodyLogLimit {
+			errBody = append(errBody[:c.errorBodyLogLimit], "..."...)
+		}
+		c.log.Errorf("InfluxDB error response body: %s", errBody)
+		writeErr := &WriteError{StatusCode: resp.StatusCode, Status: resp.Status, Body: string(errBody)}
+		return writeErr.Retryable(), writeErr
+	}
+
+	return false, nil
 }
 
-type Metric struct {
-	Metric string   `json:"metric"`
-	Points []Point  `json:"points"`
-	Type   string   `json:"type"`
-	Host   string   `json:"host,omitempty"`
-	Tags   []string `json:"tags,omitempty"`
+func (c *Client) newPostRequest(ctx context.Context, url string, contentType string, contentEncoding string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", c.userAgent)
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	if c.acceptGzip {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	return req, nil
 }
 
-type Point struct {
-	Timestamp int64
-	Value     float64
+// readResponseBody reads the body of resp, decoding it when it was gzipped.
+func readResponseBody(resp *http.Response) ([]byte, error) {
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		return ioutil.ReadAll(resp.Body)
+	}
+	reader, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
 }
 
-func New(url string, database string, user string, password string, allowSelfSigned bool, prefix string, deployment string, ip string, log *gosteno.Logger) *Client {
-	return &Client{
-		url:             url,
-		database:        database,
-		user:            user,
-		password:        password,
-		allowSelfSigned: allowSelfSigned,
-		metricPoints:    make(map[metricKey]metricValue),
-		prefix:          prefix,
-		deployment:      deployment,
-		ip:              ip,
-		log:             log,
+func fieldTypeConflicts(errBody []byte) []string {
+	var measurements []string
+	for _, match := range fieldTypeConflictPattern.FindAllSubmatch(errBody, -1) {
+		measurements = append(measurements, string(match[1]))
 	}
+	return measurements
 }
 
-func (c *Client) AlertSlowConsumerError() {
-	c.addInternalMetric("slowConsumerAlert", uint64(1))
+func (c *Client) logPostSummary(summary PostSummary) {
+	summaryJSON, err := json.Marshal(summary)
+	if err != nil {
+		c.log.Errorf("Can't marshal post summary: %s", err)
+		return
+	}
+	c.log.Info(string(summaryJSON))
 }
 
-func (c *Client) AddMetric(envelope *events.Envelope) {
-	c.totalMessagesReceived++
-	if envelope.GetEventType() != events.Envelope_ValueMetric && envelope.GetEventType() != events.Envelope_CounterEvent {
-		return
+func (c *Client) seriesURL(key batchKey) string {
+	var url string
+	if c.apiV2 {
+		bucket := c.database
+		if key.retentionPolicy != "" {
+			bucket += "/" + key.retentionPolicy
+		}
+		url = fmt.Sprintf("%s/api/v2/write?org=%s&bucket=%s", c.url, neturl.QueryEscape(c.org), neturl.QueryEscape(bucket))
+		if key.precision != "" {
+			url += "&precision=" + v2Precision(key.precision)
+		}
+	} else {
+		url = fmt.Sprintf("%s/write?db=%s", c.url, c.database)
+		if key.retentionPolicy != "" {
+			url += "&rp=" + neturl.QueryEscape(key.retentionPolicy)
+		}
+		if key.precision != "" {
+			url += "&precision=" + key.precision
+		}
 	}
+	c.log.Info("Using the following influx URL " + url)
+	return url
+}
 
-	tags := parseTags(envelope)
-	key := metricKey{
-		eventType: envelope.GetEventType(),
-		name:      getName(envelope),
-		tagsHash:  hashTags(tags),
+// v2Precision translates a 1.x write precision to its 2.x name.
+func v2Precision(precision string) string {
+	if precision == "u" {
+		return "us"
 	}
+	return precision
+}
 
-	mVal := c.metricPoints[key]
-	value := getValue(envelope)
+// retentionPolicyFor returns the retention policy of the first pattern, in
+// alphabetical order, matching the metric name. The database default is used
+// when nothing matches.
+func (c *Client) retentionPolicyFor(name string) string {
+	for _, policy := range c.retentionPolicies {
+		if policy.pattern.MatchString(name) {
+			return policy.name
+		}
+	}
+	return ""
+}
 
-	mVal.tags = tags
-	mVal.points = append(mVal.points, Point{
-		Timestamp: envelope.GetTimestamp(),
-		Value:     value,
-	})
+// detectPrecision returns the precision of the firehose timestamps about to be
+// written with the default precision.
+func (c *Client) detectPrecision(points map[metricKey]metricValue) string {
+	for key, mVal := range points {
+		if key.isInternal() || c.hasMeasurementPrecision(key.name) {
+			continue
+		}
+		for _, point := range mVal.points {
+			if point.Timestamp%int64(time.Second) != 0 {
+				return ""
+			}
+		}
+	}
+	return "s"
+}
 
-	// c.log.Infof("got-metric(%s): %v", key, mVal)
+func (c *Client) hasMeasurementPrecision(name string) bool {
+	for _, precision := range c.precisions {
+		if precision.pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
 
-	c.metricPoints[key] = mVal
+func (c *Client) precisionFor(name string) string {
+	for _, precision := range c.precisions {
+		if precision.pattern.MatchString(name) {
+			return precision.precision
+		}
+	}
+	return c.precision
 }
 
-func (c *Client) PostMetrics() error {
-	url := c.seriesURL()
+func (c *Client) populateInternalMetrics() {
+	c.addInternalMetric("totalMessagesReceived", float64(atomic.LoadUint64(&c.totalMessagesReceived)))
+	c.addInternalMetric("totalMetricsSent", float64(atomic.LoadUint64(&c.totalMetricsSent)))
+	if c.emitRuntimeMetrics {
+		c.addRuntimeMetrics()
+	}
+	if c.maxBufferBytes > 0 {
+		c.addInternalMetric("pointsDroppedOverBufferCap", float64(c.bufferCapDrops))
+	}
 
-	c.populateInternalMetrics()
-	numMetrics := len(c.metricPoints)
-	c.log.Infof("Posting %d metrics", numMetrics)
+	if c.tagSetReportInterval > 0 && c.now().Sub(c.lastTagSetReport) >= c.tagSetReportInterval {
+		c.addTagSetCounts()
+		c.lastTagSetReport = c.now()
+	}
 
-	seriesBytes, metricsCount := c.formatMetrics()
+	if !c.containsSlowConsumerAlert() {
+		c.addInternalMetric("slowConsumerAlert", 0)
+	}
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	if !c.tokenExpiry.IsZero() {
+		c.addInternalMetric("tokenExpirySeconds", c.tokenExpiry.Sub(c.now()).Seconds())
 	}
-	httpClient := &http.Client{Transport: tr}
 
-	resp, err := httpClient.Post(url, "application/binary", bytes.NewBuffer(seriesBytes))
-	if err != nil {
-		return err
+	if c.reportConfigWarnings {
+		c.addInternalMetric("configWarnings", float64(c.configWarnings))
 	}
 
-	defer resp.Body.Close()
-	if resp.StatusCode >= 300 || resp.StatusCode < 200 {
-		errBody, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return fmt.Errorf("Can't read response body: %s", resp.Status)
+	if c.silenceThreshold > 0 {
+		var silent float64
+		if c.now().Sub(c.lastReceived) >= c.silenceThreshold {
+			silent = 1
 		}
-		return fmt.Errorf("InfluxDB request returned HTTP response: %s;\n%s", resp.Status, string(errBody))
+		c.addInternalMetric("firehoseSilent", silent)
 	}
+}
 
-	c.totalMetricsSent += metricsCount
-	c.metricPoints = make(map[metricKey]metricValue)
+// addRuntimeMetrics reports how the nozzle itself is doing: what it receives,
+// retries and drops, and its goroutine count.
+func (c *Client) addRuntimeMetrics() {
+	c.addInternalMetric("totalBytesReceived", float64(c.totalBytesReceived))
+	c.addSentToReceivedRatio()
+	c.addInternalMetric("envelopeReceiveRate", c.receiveRate.rate(c.now()))
+	c.addInternalMetric("distinctDeployments", float64(len(c.deploymentsSeen)))
+	c.addInternalMetric("distinctApplications", float64(len(c.applicationsSeen)))
+	c.addInternalMetric("schemaConflicts", float64(c.schemaConflicts))
+	c.addInternalMetric("quarantinedMeasurements", float64(len(c.quarantined)))
+	c.addInternalMetric("pointsDroppedOnFailure", float64(c.pointsDropped))
+	c.addInternalMetric("postRetries", float64(c.postRetries))
+	c.addInternalMetric("skippedPosts", float64(c.skippedPosts))
 
-	return nil
+	var unsentAge float64
+	if c.failedPosts > 0 {
+		unsentAge = c.now().Sub(c.firstFailedPost).Seconds()
+	}
+	c.addInternalMetric("oldestUnsentBatchAgeSeconds", unsentAge)
+	c.addInternalMetric("emptyMetricNames", float64(atomic.LoadUint64(&c.emptyNames)))
+	c.addInternalMetric("droppedMetrics", float64(atomic.LoadUint64(&c.droppedMetrics)))
+
+	for category, count := range c.consumerErrors {
+		c.addInternalMetric("firehoseErrors."+category, float64(count))
+	}
+
+	c.addInternalMetric("goroutines", float64(runtime.NumGoroutine()))
+
+	if !c.buildInfoSent {
+		c.addTaggedInternalMetric("build_info", 1, tag{key: "version", value: Version}, tag{key: "commit", value: Commit})
+	}
 }
 
-func (c *Client) seriesURL() string {
-	url := fmt.Sprintf("%s/write?db=%s", c.url, c.database)
-	c.log.Info("Using the following influx URL " + url)
-	return url
+// addSentToReceivedRatio reports the metrics sent since the last post over the
+// messages received in the interval that post covered, then starts a new interval.
+func (c *Client) addSentToReceivedRatio() {
+	received := atomic.LoadUint64(&c.totalMessagesReceived)
+	sent := atomic.LoadUint64(&c.totalMetricsSent)
+	if c.intervalReceived > 0 {
+		c.addInternalMetric("sentToReceivedRatio", float64(sent-c.sentMark)/float64(c.intervalReceived))
+	}
+	c.intervalReceived = received - c.receivedMark
+	c.receivedMark = received
+	c.sentMark = sent
 }
 
-func (c *Client) populateInternalMetrics() {
-	c.addInternalMetric("totalMessagesReceived", c.totalMessagesReceived)
-	c.addInternalMetric("totalMetricsSent", c.totalMetricsSent)
+func (c *Client) addTagSetCounts() {
+	tagSets := make(map[string]int)
+	for key := range c.metricPoints {
+		if !key.isInternal() {
+			tagSets[c.measurementName(key)]++
+		}
+	}
+	for measurement, count := range tagSets {
+		c.addTaggedInternalMetric("distinctTagSets", float64(count), tag{key: "measurement", value: measurement})
+	}
+}
 
-	if !c.containsSlowConsumerAlert() {
-		c.addInternalMetric("slowConsumerAlert", uint64(0))
+func (c *Client) containsFirehoseMetrics() bool {
+	for key := range c.metricPoints {
+		if !key.isInternal() {
+			return true
+		}
 	}
+	return false
 }
 
 func (c *Client) containsSlowConsumerAlert() bool {
@@ -159,115 +1856,602 @@ func (c *Client) containsSlowConsumerAlert() bool {
 	return ok
 }
 
-func (c *Client) formatMetrics() ([]byte, uint64) {
-	var buffer bytes.Buffer
+func (c *Client) formatMetrics(points map[metricKey]metricValue) (map[batchKey]*batch, uint64) {
+	if c.autoPrecision {
+		c.precision = c.detectPrecision(points)
+	}
+	batches := make(map[batchKey]*batch)
+	chunks := make(map[batchKey]int)
+	var seriesCount, totalTags, maxTags int
 
-	for key, mVal := range c.metricPoints {
-		for _, point := range mVal.points {
-			buffer.WriteString(c.prefix + key.name)
-			if len(mVal.tags) > 0 {
-				buffer.WriteString(",")
-				buffer.WriteString(formatTags(mVal.tags))
+	for key, mVal := range points {
+		bKey := c.internalBatchKey()
+		if !key.isInternal() {
+			bKey = batchKey{
+				retentionPolicy: c.retentionPolicyFor(key.name),
+				precision:       c.precisionFor(key.name),
+			}
+		}
+		measurement := c.measurementName(key)
+		if _, ok := c.quarantined[measurement]; ok {
+			continue
+		}
+		if !key.isInternal() {
+			mVal.fieldType = c.fieldTypes[key.name]
+		}
+		chunkKey := bKey
+		chunkKey.chunk = chunks[bKey]
+		if b := batches[chunkKey]; b != nil && c.maxLinesPerRequest > 0 && b.points >= c.maxLinesPerRequest {
+			chunks[bKey]++
+			chunkKey.chunk = chunks[bKey]
+		}
+		if batches[chunkKey] == nil {
+			batches[chunkKey] = c.newBatch(chunkKey)
+		}
+		written := batches[chunkKey].points
+		batches[chunkKey].writeSeries(measurement, mVal)
+		batches[chunkKey].keys = append(batches[chunkKey].keys, key)
+		if !key.isInternal() && batches[chunkKey].points > written {
+			seriesCount++
+			totalTags += len(mVal.tags)
+			if len(mVal.tags) > maxTags {
+				maxTags = len(mVal.tags)
+			}
+		}
+	}
+
+	var avgTags float64
+	if seriesCount > 0 {
+		avgTags = float64(totalTags) / float64(seriesCount)
+	}
+	internal := c.internalBatchKey()
+	if batches[internal] == nil {
+		batches[internal] = c.newBatch(internal)
+	}
+	if c.emitRuntimeMetrics {
+		batches[internal].writeSeries(c.internalPrefix+"maxTagsPerSeries", c.internalMetricValue(float64(maxTags)))
+		batches[internal].writeSeries(c.internalPrefix+"avgTagsPerSeries", c.internalMetricValue(avgTags))
+		batches[internal].writeSeries(c.internalPrefix+"oversizedLinesDropped", c.internalMetricValue(float64(c.oversizedLinesDropped+droppedLines(batches))))
+	}
+	if c.datadogURL != "" {
+		batches[internal].writeSeries(c.internalPrefix+"datadogPostFailures", c.internalMetricValue(float64(c.datadogPostFailures)))
+	}
+
+	for _, b := range batches {
+		if err := b.finish(); err != nil {
+			c.log.Errorf("Can't serialize batch: %s", err)
+		}
+	}
+
+	return batches, uint64(len(points))
+}
+
+// measurementName returns the name a buffered series is written as.
+func (c *Client) measurementName(key metricKey) string {
+	if key.isInternal() {
+		return c.internalPrefix + key.name
+	}
+	return c.prefix + applyCase(key.name, c.measurementCase) + c.measurementSuffix
+}
+
+func applyCase(name string, policy string) string {
+	switch policy {
+	case MeasurementCaseLower:
+		return strings.ToLower(name)
+	case MeasurementCaseUpper:
+		return strings.ToUpper(name)
+	case MeasurementCaseSnake:
+		return snakeCase(name)
+	default:
+		return name
+	}
+}
+
+// snakeCase lowercases name, separating the words of camel case runs with
+// underscores, e.g. HTTPRequestCount becomes http_request_count.
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var snake []rune
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 {
+			prev := runes[i-1]
+			nextIsLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextIsLower) {
+				snake = append(snake, '_')
 			}
-			buffer.WriteString(" ")
-			buffer.WriteString(formatValues(point))
-			buffer.WriteString(" ")
-			buffer.WriteString(formatTimestamp(point))
-			buffer.WriteString("\n")
 		}
+		snake = append(snake, unicode.ToLower(r))
+	}
+	return string(snake)
+}
+
+func droppedLines(batches map[batchKey]*batch) uint64 {
+	var dropped uint64
+	for _, b := range batches {
+		dropped += uint64(b.dropped)
+	}
+	return dropped
+}
+
+// bufferPool recycles the buffers request bodies are built in across posts.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func getBuffer() *bytes.Buffer {
+	buffer := bufferPool.Get().(*bytes.Buffer)
+	buffer.Reset()
+	return buffer
+}
+
+// releaseBatches returns the buffers of sent batches to the pool, once the
+// transport has closed every request body reading them.
+func releaseBatches(batches map[batchKey]*batch) {
+	for _, b := range batches {
+		b.release()
+	}
+}
+
+// batch holds the line protocol for a single write request.
+type batch struct {
+	// refs counts the holders of the buffer: the batch itself and every request
+	// body reading it. The buffer goes back to the pool when it drops to zero.
+	refs           int32
+	buffer         *bytes.Buffer
+	lineTerminator string
+	constantField  string
+	maxLineLength  int
+	precision      string
+	series         int
+	points         int
+	dropped        int
+	contentType    string
+	encoding       string
+	gzipLevel      int
+	json           *jsonPayload
+	keys           []metricKey
+	sent           bool
+}
+
+func (c *Client) newBatch(key batchKey) *batch {
+	b := &batch{
+		refs:           1,
+		buffer:         getBuffer(),
+		precision:      key.precision,
+		lineTerminator: c.lineTerminator,
+		constantField:  c.constantField,
+		maxLineLength:  c.maxLineLength,
+		contentType:    "text/plain; charset=utf-8",
+	}
+	if c.gzipWrites && c.udpConn == nil {
+		b.encoding = "gzip"
+		b.gzipLevel = c.gzipLevel
+	}
+	if c.writeFormat == WriteFormatJSON {
+		b.contentType = "application/json"
+		b.json = &jsonPayload{
+			Database:        c.database,
+			RetentionPolicy: key.retentionPolicy,
+			Precision:       key.precision,
+			Points:          []jsonPoint{},
+		}
+	}
+	return b
+}
+
+func (b *batch) release() {
+	if atomic.AddInt32(&b.refs, -1) == 0 {
+		bufferPool.Put(b.buffer)
+	}
+}
+
+// attachBody makes req read the buffer through bodies holding on to it until they
+// are closed, since the transport may still be reading a body after Do returns.
+func (b *batch) attachBody(req *http.Request) {
+	req.Body = b.newBody(req.Body)
+	getBody := req.GetBody
+	req.GetBody = func() (io.ReadCloser, error) {
+		body, err := getBody()
+		if err != nil {
+			return nil, err
+		}
+		return b.newBody(body), nil
+	}
+}
+
+func (b *batch) newBody(body io.ReadCloser) io.ReadCloser {
+	atomic.AddInt32(&b.refs, 1)
+	return &batchBody{ReadCloser: body, batch: b}
+}
+
+// batchBody is a request body reading the buffer of a batch.
+type batchBody struct {
+	io.ReadCloser
+	batch *batch
+	once  sync.Once
+}
+
+func (r *batchBody) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.batch.release)
+	return err
+}
+
+func (b *batch) writeSeries(measurement string, mVal metricValue) {
+	b.series++
+	if b.json != nil {
+		b.writeJSONSeries(measurement, mVal)
+		return
+	}
+	line := getBuffer()
+	defer bufferPool.Put(line)
+	for _, point := range mVal.points {
+		line.Reset()
+		line.WriteString(measurementEscaper.Replace(measurement))
+		if len(mVal.tags) > 0 {
+			line.WriteString(",")
+			line.WriteString(formatTags(mVal.tags))
+		}
+		line.WriteString(" ")
+		line.WriteString(formatValues(point, mVal.fieldType))
+		if b.constantField != "" {
+			line.WriteString(",")
+			line.WriteString(b.constantField)
+		}
+		line.WriteString(" ")
+		line.WriteString(formatTimestamp(point, b.precision))
+
+		if b.maxLineLength > 0 && line.Len() > b.maxLineLength {
+			b.dropped++
+			continue
+		}
+		b.points++
+		b.buffer.Write(line.Bytes())
+		b.buffer.WriteString(b.lineTerminator)
+	}
+}
+
+// finish serializes the points of a JSON batch into its buffer and compresses the
+// buffer when the batch is gzip encoded.
+func (b *batch) finish() error {
+	if b.json != nil {
+		body, err := json.Marshal(b.json)
+		if err != nil {
+			return err
+		}
+		b.buffer.Write(body)
 	}
 
-	return buffer.Bytes(), uint64(len(c.metricPoints))
+	if b.encoding == "gzip" {
+		compressed := getBuffer()
+		writer, err := gzip.NewWriterLevel(compressed, b.gzipLevel)
+		if err != nil {
+			return err
+		}
+		if _, err := writer.Write(b.buffer.Bytes()); err != nil {
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		bufferPool.Put(b.buffer)
+		b.buffer = compressed
+	}
+	return nil
 }
 
-func formatTags(tags []string) string {
+// measurementEscaper escapes the characters line protocol gives a meaning to in
+// measurement names.
+var measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+
+// tagEscaper escapes the characters line protocol gives a meaning to in tag keys
+// and values.
+var tagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+func formatTags(tags []tag) string {
 	var newTags string
-	for index, tag := range tags {
+	for index, t := range tags {
 		if index > 0 {
 			newTags += ","
 		}
-
-		newTags += tag
+		newTags += tagEscaper.Replace(t.key) + "=" + tagEscaper.Replace(t.value)
 	}
 	return newTags
 }
 
-func formatValues(point Point) string {
-	return "value=" + strconv.FormatFloat(point.Value, 'f', -1, 64)
+func formatValues(point Point, fieldType string) string {
+	values := "value=" + formatValue(point.Value, fieldType)
+	for _, field := range point.Fields {
+		values += "," + field
+	}
+	return values
+}
+
+// formatValue formats value as a line protocol field value of fieldType.
+func formatValue(value float64, fieldType string) string {
+	switch fieldType {
+	case FieldTypeInt:
+		return strconv.FormatInt(int64(math.Round(value)), 10) + "i"
+	case FieldTypeBool:
+		return strconv.FormatBool(value != 0)
+	case FieldTypeString:
+		return `"` + strconv.FormatFloat(value, 'f', -1, 64) + `"`
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
 }
 
-func formatTimestamp(point Point) string {
+func formatTimestamp(point Point, precision string) string {
+	if unit, ok := precisionUnits[precision]; ok {
+		return strconv.FormatInt(point.Timestamp/unit, 10)
+	}
 	return strconv.FormatInt(point.Timestamp, 10)
 }
 
-func (c *Client) addInternalMetric(name string, value uint64) {
+func (c *Client) addInternalMetric(name string, value float64) {
 	key := metricKey{
 		name:     name,
 		tagsHash: c.tagsHash,
 	}
 
+	c.metricPoints[key] = c.internalMetricValue(value)
+}
+
+// addTaggedInternalMetric adds an internal metric with tags beyond the standard
+// ones, as its own series.
+func (c *Client) addTaggedInternalMetric(name string, value float64, tags ...tag) {
+	key := metricKey{
+		name:     name,
+		tagsHash: c.tagsHash + hashTags(tags),
+	}
+
+	mVal := c.internalMetricValue(value)
+	mVal.tags = append(mVal.tags, tags...)
+	c.metricPoints[key] = mVal
+}
+
+func (c *Client) internalMetricValue(value float64) metricValue {
 	point := Point{
-		Timestamp: time.Now().Unix(),
-		Value:     float64(value),
+		Timestamp: c.now().UnixNano(),
+		Value:     value,
 	}
 
-	mValue := metricValue{
-		tags: []string{
-			fmt.Sprintf("ip=%s", c.ip),
-			fmt.Sprintf("deployment=%s", c.deployment),
-		},
+	return metricValue{
+		tags: append([]tag{
+			{key: "ip", value: c.ip},
+			{key: "deployment", value: c.deployment},
+		}, c.staticTags...),
 		points: []Point{point},
 	}
-
-	c.metricPoints[key] = mValue
 }
 
-func getName(envelope *events.Envelope) string {
+func getMetricName(envelope *events.Envelope) string {
 	switch envelope.GetEventType() {
 	case events.Envelope_ValueMetric:
-		return envelope.GetOrigin() + "." + envelope.GetValueMetric().GetName()
+		return envelope.GetValueMetric().GetName()
 	case events.Envelope_CounterEvent:
-		return envelope.GetOrigin() + "." + envelope.GetCounterEvent().GetName()
+		return envelope.GetCounterEvent().GetName()
+	case events.Envelope_HttpStartStop:
+		return "http_latency_ms"
 	default:
 		panic("Unknown event type")
 	}
 }
 
-func getValue(envelope *events.Envelope) float64 {
+func orPlaceholder(part string) string {
+	if part == "" {
+		return emptyNamePlaceholder
+	}
+	return part
+}
+
+func getValue(envelope *events.Envelope, counterMode string) float64 {
 	switch envelope.GetEventType() {
 	case events.Envelope_ValueMetric:
 		return envelope.GetValueMetric().GetValue()
 	case events.Envelope_CounterEvent:
+		if counterMode == CounterModeDelta {
+			return float64(envelope.GetCounterEvent().GetDelta())
+		}
 		return float64(envelope.GetCounterEvent().GetTotal())
+	case events.Envelope_HttpStartStop:
+		return getLatencyMs(envelope.GetHttpStartStop())
 	default:
 		panic("Unknown event type")
 	}
 }
 
-func parseTags(envelope *events.Envelope) []string {
-	tags := appendTagIfNotEmpty(nil, "deployment", envelope.GetDeployment())
-	tags = appendTagIfNotEmpty(tags, "job", envelope.GetJob())
-	tags = appendTagIfNotEmpty(tags, "index", envelope.GetIndex())
-	tags = appendTagIfNotEmpty(tags, "ip", envelope.GetIp())
+// getLatencyMs returns the time taken to serve a request in milliseconds.
+func getLatencyMs(httpStartStop *events.HttpStartStop) float64 {
+	latency := httpStartStop.GetStopTimestamp() - httpStartStop.GetStartTimestamp()
+	return float64(latency) / float64(time.Millisecond)
+}
+
+func getAttribute(envelope *events.Envelope, attribute string) string {
+	switch attribute {
+	case "deployment":
+		return envelope.GetDeployment()
+	case "job":
+		return envelope.GetJob()
+	case "index":
+		return envelope.GetIndex()
+	case "ip":
+		return envelope.GetIp()
+	case "origin":
+		return envelope.GetOrigin()
+	default:
+		return ""
+	}
+}
+
+func attributeMode(mapping map[string]string, attribute string) string {
+	if mode, ok := mapping[attribute]; ok {
+		return mode
+	}
+	return defaultEnvelopeFieldMapping[attribute]
+}
+
+func (c *Client) parseTags(envelope *events.Envelope) []tag {
+	var tags []tag
+	for _, attribute := range EnvelopeAttributes {
+		if attributeMode(c.envelopeFieldMapping, attribute) == MappingTag {
+			value := getAttribute(envelope, attribute)
+			if attribute == "index" && c.indexFormat == IndexFormatShort {
+				value = shortIndex(value)
+			}
+			tagName := attribute
+			if name, ok := c.tagNames[attribute]; ok {
+				tagName = name
+			}
+			tags = c.appendTagIfNotEmpty(tags, tagName, value)
+		}
+	}
 	for tname, tvalue := range envelope.GetTags() {
-		tags = appendTagIfNotEmpty(tags, tname, tvalue)
+		if tname == sourceIDTagName && !c.sourceIDTag {
+			continue
+		}
+		if standardName, ok := cfTagNames[tname]; ok && c.promoteCFTags {
+			tname = standardName
+		}
+		tags = c.appendTagIfNotEmpty(tags, tname, tvalue)
 	}
 	return tags
 }
 
-func appendTagIfNotEmpty(tags []string, key, value string) []string {
-	if value != "" {
-		tags = append(tags, fmt.Sprintf("%s=%s", key, value))
+// limitTags applies MaxTagsPerSeries to the tags of a series once they are all
+// assembled, then adds the static tags, which are never dropped.
+func (c *Client) limitTags(tags []tag) []tag {
+	if c.maxTagsPerSeries > 0 && len(tags) > c.maxTagsPerSeries {
+		sort.Sort(byKey(tags))
+		tags = tags[:c.maxTagsPerSeries]
+	}
+	for _, t := range c.staticTags {
+		tags = c.appendTagIfNotEmpty(tags, t.key, t.value)
 	}
 	return tags
 }
 
-func hashTags(tags []string) string {
-	sort.Strings(tags)
-	hash := ""
-	for _, tag := range tags {
-		tagHash := sha1.Sum([]byte(tag))
-		hash += string(tagHash[:])
+// redactTags redacts the values of the RedactedTags, matching every tag by the
+// key it is written with, after TagNames renames and CF tag promotion.
+func (c *Client) redactTags(tags []tag) {
+	for i := range tags {
+		tags[i].value = c.redact(tags[i].key, tags[i].value)
+	}
+}
+
+func (c *Client) redact(key, value string) string {
+	if value == "" || !c.redactedTags[key] {
+		return value
+	}
+	if c.redactionMode == RedactionHash {
+		hash := sha1.Sum([]byte(value))
+		return hex.EncodeToString(hash[:8])
+	}
+	return redactionMask
+}
+
+func shortIndex(index string) string {
+	if uuidPattern.MatchString(index) {
+		return strings.ToLower(index[:8])
+	}
+	if number, err := strconv.ParseUint(index, 10, 64); err == nil {
+		return strconv.FormatUint(number, 10)
+	}
+	return index
+}
+
+func (c *Client) appendTagIfNotEmpty(tags []tag, key, value string) []tag {
+	if value == "" {
+		return tags
 	}
-	return hash
+
+	for index, existing := range tags {
+		if existing.key == key {
+			if c.duplicateTagPolicy == DuplicateTagLastWins {
+				tags[index].value = value
+			}
+			return tags
+		}
+	}
+	return append(tags, tag{key: key, value: value})
+}
+
+// counterInstance identifies the instance which emitted a counter, as job/index
+// when known and by its ip otherwise.
+func counterInstance(envelope *events.Envelope) string {
+	if envelope.GetJob() != "" && envelope.GetIndex() != "" {
+		return envelope.GetJob() + "/" + envelope.GetIndex()
+	}
+	return envelope.GetIp()
+}
+
+func parseFields(envelope *events.Envelope, mapping map[string]string) []string {
+	var fields []string
+	for _, attribute := range EnvelopeAttributes {
+		if attributeMode(mapping, attribute) == MappingField {
+			fields = appendFieldIfNotEmpty(fields, attribute, getAttribute(envelope, attribute))
+		}
+	}
+	return fields
+}
+
+func appendFieldIfNotEmpty(fields []string, key, value string) []string {
+	if value != "" {
+		fields = append(fields, formatStringField(key, value))
+	}
+	return fields
+}
+
+func formatStringField(key, value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return fmt.Sprintf("%s=\"%s\"", key, value)
+}
+
+// sortTags puts the tags of a series in the order they are written in.
+func (c *Client) sortTags(tags []tag) {
+	if len(c.tagRanks) == 0 {
+		sort.Sort(byKey(tags))
+		return
+	}
+	sort.Sort(byTagOrder{tags: tags, ranks: c.tagRanks})
+}
+
+// byKey sorts tags by key, then by value.
+type byKey []tag
+
+func (t byKey) Len() int      { return len(t) }
+func (t byKey) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t byKey) Less(i, j int) bool {
+	if t[i].key != t[j].key {
+		return t[i].key < t[j].key
+	}
+	return t[i].value < t[j].value
+}
+
+type byTagOrder struct {
+	tags  []tag
+	ranks map[string]int
+}
+
+func (t byTagOrder) Len() int      { return len(t.tags) }
+func (t byTagOrder) Swap(i, j int) { t.tags[i], t.tags[j] = t.tags[j], t.tags[i] }
+func (t byTagOrder) Less(i, j int) bool {
+	rankI, rankedI := t.ranks[t.tags[i].key]
+	rankJ, rankedJ := t.ranks[t.tags[j].key]
+	switch {
+	case rankedI && rankedJ:
+		return rankI < rankJ
+	case rankedI != rankedJ:
+		return rankedI
+	}
+	return byKey(t.tags).Less(i, j)
+}
+
+// hashTags returns a hex digest identifying a tag set regardless of the order of
+// its tags. The tags passed in are left untouched.
+func hashTags(tags []tag) string {
+	sorted := append([]tag(nil), tags...)
+	sort.Sort(byKey(sorted))
+	hash := sha1.Sum([]byte(formatTags(sorted)))
+	return hex.EncodeToString(hash[:])
 }
@@ -0,0 +1,68 @@
+package influxdbclient_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andrew-edgar/influxdb-firehose-nozzle/influxdbclient"
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+func BenchmarkPostMetrics(b *testing.B) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	log := gosteno.NewLogger("influxdbclient benchmark")
+	c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+		})
+		if err := c.PostMetrics(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPostMetricsLargeBatch(b *testing.B) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	log := gosteno.NewLogger("influxdbclient benchmark")
+	c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 1000; j++ {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000 + int64(j)),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(float64(j)),
+				},
+			})
+		}
+		if err := c.PostMetrics(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,12 +1,27 @@
 package influxdbclient_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/andrew-edgar/influxdb-firehose-nozzle/influxdbclient"
+	"github.com/andrew-edgar/influxdb-firehose-nozzle/testhelpers"
 	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/datadogclient"
 
 	"github.com/cloudfoundry/gosteno"
@@ -19,10 +34,15 @@ import (
 
 var (
 	bodies       [][]byte
+	requestURIs  []string
+	userAgents   []string
+	authHeaders  []string
+	contentTypes []string
 	responseCode int
+	responseBody []byte
 )
 
-var _ = Describe("DatadogClient", func() {
+var _ = Describe("InfluxDbClient", func() {
 	var (
 		ts  *httptest.Server
 		log *gosteno.Logger
@@ -30,18 +50,27 @@ var _ = Describe("DatadogClient", func() {
 
 	BeforeEach(func() {
 		bodies = nil
+		requestURIs = nil
+		userAgents = nil
+		authHeaders = nil
+		contentTypes = nil
+		responseBody = nil
 		responseCode = http.StatusOK
 		ts = httptest.NewServer(http.HandlerFunc(handlePost))
-		log = gosteno.NewLogger("datadogclient test")
+		log = gosteno.NewLogger("influxdbclient test")
 	})
 
 	It("sends tags", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
 
 		c.AddMetric(&events.Envelope{
 			Origin:    proto.String("test-origin"),
 			Timestamp: proto.Int64(1000000000),
 			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
 
 			// fields that gets sent as tags
 			Deployment: proto.String("deployment-name"),
@@ -60,29 +89,20 @@ var _ = Describe("DatadogClient", func() {
 		Expect(err).ToNot(HaveOccurred())
 
 		Eventually(bodies).Should(HaveLen(1))
-		var payload datadogclient.Payload
-		err = json.Unmarshal(bodies[0], &payload)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(payload.Series).To(HaveLen(4))
-
-		var metric datadogclient.Metric
-		Expect(metric.Tags).To(ConsistOf(
-			"deployment:deployment-name",
-			"job:doppler",
-			"index:1",
-			"ip:10.0.1.2",
-			"protocol:http",
-			"request_id:a1f5-deadbeef",
-		))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.test-origin.metricName,deployment=deployment-name,index=1,ip=10.0.1.2,job=doppler,protocol=http,request_id=a1f5-deadbeef value=5 1000000000\n"))
 	})
 
 	It("uses tags as an identifier for batching purposes", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
 
 		c.AddMetric(&events.Envelope{
 			Origin:    proto.String("test-origin"),
 			Timestamp: proto.Int64(1000000000),
 			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
 
 			// fields that gets sent as tags
 			Deployment: proto.String("deployment-name"),
@@ -101,6 +121,10 @@ var _ = Describe("DatadogClient", func() {
 			Origin:    proto.String("test-origin"),
 			Timestamp: proto.Int64(1000000000),
 			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
 
 			// fields that gets sent as tags
 			Deployment: proto.String("deployment-name"),
@@ -119,14 +143,12 @@ var _ = Describe("DatadogClient", func() {
 		Expect(err).ToNot(HaveOccurred())
 
 		Eventually(bodies).Should(HaveLen(1))
-		var payload datadogclient.Payload
-		err = json.Unmarshal(bodies[0], &payload)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(payload.Series).To(HaveLen(5))
+		series := regexp.MustCompile(`(?m)^influxdb\.nozzle\.test-origin\.metricName,`).FindAllString(string(bodies[0]), -1)
+		Expect(series).To(HaveLen(2))
 	})
 
 	It("ignores messages that aren't value metrics or counter events", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
 
 		c.AddMetric(&events.Envelope{
 			Origin:    proto.String("origin"),
@@ -163,7 +185,7 @@ var _ = Describe("DatadogClient", func() {
 	})
 
 	It("generates aggregate messages even when idle", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
 
 		err := c.PostMetrics()
 		Expect(err).ToNot(HaveOccurred())
@@ -177,7 +199,7 @@ var _ = Describe("DatadogClient", func() {
 	})
 
 	It("posts ValueMetrics in JSON format", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
 
 		c.AddMetric(&events.Envelope{
 			Origin:    proto.String("origin"),
@@ -210,7 +232,7 @@ var _ = Describe("DatadogClient", func() {
 	})
 
 	It("registers metrics with the same name but different tags as different", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
 
 		c.AddMetric(&events.Envelope{
 			Origin:    proto.String("origin"),
@@ -243,7 +265,7 @@ var _ = Describe("DatadogClient", func() {
 	})
 
 	It("posts CounterEvents in JSON format and empties map after post", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
 
 		c.AddMetric(&events.Envelope{
 			Origin:    proto.String("origin"),
@@ -274,7 +296,7 @@ var _ = Describe("DatadogClient", func() {
 	})
 
 	It("sends a value 1 for the slowConsumerAlert metric when consumer error is set", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
 
 		c.AlertSlowConsumerError()
 
@@ -285,7 +307,7 @@ var _ = Describe("DatadogClient", func() {
 	})
 
 	It("sends a value 0 for the slowConsumerAlert metric when consumer error is not set", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
 
 		err := c.PostMetrics()
 		Expect(err).ToNot(HaveOccurred())
@@ -294,7 +316,7 @@ var _ = Describe("DatadogClient", func() {
 	})
 
 	It("unsets the slow consumer error once it publishes the alert to datadog", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
 
 		c.AlertSlowConsumerError()
 
@@ -304,32 +326,3301 @@ var _ = Describe("DatadogClient", func() {
 		Eventually(bodies).Should(HaveLen(1))
 	})
 
-	It("returns an error when datadog responds with a non 200 response code", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+	It("returns an error when InfluxDB responds with a non 200 response code", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
 
 		responseCode = http.StatusBadRequest // 400
 		err := c.PostMetrics()
 		Expect(err).To(HaveOccurred())
-		Expect(err.Error()).To(ContainSubstring("datadog request returned HTTP response: 400 Bad Request"))
+		Expect(err.Error()).To(ContainSubstring("InfluxDB request returned HTTP response: 400 Bad Request"))
 
 		responseCode = http.StatusSwitchingProtocols // 101
 		err = c.PostMetrics()
 		Expect(err).To(HaveOccurred())
-		Expect(err.Error()).To(ContainSubstring("datadog request returned HTTP response: 101"))
+		Expect(err.Error()).To(ContainSubstring("InfluxDB request returned HTTP response: 101"))
 
 		responseCode = http.StatusAccepted // 201
 		err = c.PostMetrics()
 		Expect(err).ToNot(HaveOccurred())
 	})
-})
 
-func handlePost(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		panic("No body!")
-	}
+	It("returns a permanent WriteError when InfluxDB rejects the write", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
 
-	bodies = append(bodies, body)
-	w.WriteHeader(responseCode)
+		responseCode = http.StatusBadRequest
+		responseBody = []byte("unable to parse")
+		err := c.PostMetrics()
+
+		var writeErr *influxdbclient.WriteError
+		Expect(errors.As(err, &writeErr)).To(BeTrue())
+		Expect(writeErr.StatusCode).To(Equal(http.StatusBadRequest))
+		Expect(writeErr.Body).To(Equal("unable to parse"))
+		Expect(writeErr.Retryable()).To(BeFalse())
+	})
+
+	It("returns a retryable WriteError when InfluxDB is unavailable", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+
+		responseCode = http.StatusServiceUnavailable
+		err := c.PostMetrics()
+
+		var writeErr *influxdbclient.WriteError
+		Expect(errors.As(err, &writeErr)).To(BeTrue())
+		Expect(writeErr.StatusCode).To(Equal(http.StatusServiceUnavailable))
+		Expect(writeErr.Retryable()).To(BeTrue())
+	})
+
+	It("maps envelope attributes to tags, fields or nothing", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetEnvelopeFieldMapping(map[string]string{
+			"index": influxdbclient.MappingField,
+			"ip":    influxdbclient.MappingOmit,
+		})
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+			Deployment: proto.String("deployment-name"),
+			Job:        proto.String("doppler"),
+			Index:      proto.String("1"),
+			Ip:         proto.String("10.0.1.2"),
+		})
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName,deployment=deployment-name,job=doppler value=5,index=\"1\" 1000000000\n"))
+		Expect(string(bodies[0])).ToNot(ContainSubstring("10.0.1.2"))
+	})
+	It("renames the tags of envelope attributes", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetTagNames(map[string]string{"deployment": "bosh_deployment"})
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+			Deployment: proto.String("deployment-name"),
+			Job:        proto.String("doppler"),
+		})
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName,bosh_deployment=deployment-name,job=doppler value=5 1000000000\n"))
+	})
+	It("sends the max and average number of tags per series", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetEmitRuntimeMetrics(true)
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+			Deployment: proto.String("deployment-name"),
+			Job:        proto.String("doppler"),
+		})
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("otherMetricName"),
+				Value: proto.Float64(5),
+			},
+			Deployment: proto.String("deployment-name"),
+			Job:        proto.String("doppler"),
+			Index:      proto.String("1"),
+			Ip:         proto.String("10.0.1.2"),
+		})
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.maxTagsPerSeries,ip=dummy-ip,deployment=test-deployment value=4 "))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.avgTagsPerSeries,ip=dummy-ip,deployment=test-deployment value=3 "))
+	})
+	It("emits counter deltas normalized to the configured interval as rates", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetCounterRateInterval(4 * time.Second)
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_CounterEvent.Enum(),
+			CounterEvent: &events.CounterEvent{
+				Name:  proto.String("counterName"),
+				Delta: proto.Uint64(6),
+				Total: proto.Uint64(11),
+			},
+		})
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.counterName value=11 1000000000\n"))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.counterName.rate value=1.5 1000000000\n"))
+	})
+	It("sends firehoseSilent once no envelopes arrived within the silence threshold", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		now := time.Unix(1000, 0)
+		c.SetClock(func() time.Time { return now })
+		c.SetSilenceThreshold(time.Minute)
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		now = now.Add(2 * time.Minute)
+		err = c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(2))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.firehoseSilent,ip=dummy-ip,deployment=test-deployment value=0 1000000000000\n"))
+		Expect(string(bodies[1])).To(ContainSubstring("influxdb.nozzle.firehoseSilent,ip=dummy-ip,deployment=test-deployment value=1 1120000000000\n"))
+	})
+	Context("when an envelope tag collides with a standard tag", func() {
+		var envelope *events.Envelope
+
+		BeforeEach(func() {
+			envelope = &events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+				},
+				Deployment: proto.String("deployment-name"),
+				Tags: map[string]string{
+					"deployment": "tagged-deployment",
+				},
+			}
+		})
+
+		It("keeps the standard tag with the first-wins policy", func() {
+			c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+			c.SetDuplicateTagPolicy(influxdbclient.DuplicateTagFirstWins)
+
+			c.AddMetric(envelope)
+			err := c.PostMetrics()
+			Expect(err).ToNot(HaveOccurred())
+
+			Eventually(bodies).Should(HaveLen(1))
+			Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName,deployment=deployment-name value=5 1000000000\n"))
+		})
+
+		It("keeps the envelope tag with the last-wins policy", func() {
+			c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+			c.SetDuplicateTagPolicy(influxdbclient.DuplicateTagLastWins)
+
+			c.AddMetric(envelope)
+			err := c.PostMetrics()
+			Expect(err).ToNot(HaveOccurred())
+
+			Eventually(bodies).Should(HaveLen(1))
+			Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName,deployment=tagged-deployment value=5 1000000000\n"))
+		})
+	})
+	It("writes metrics matching a retention policy pattern with that retention policy", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		err := c.SetRetentionPolicies(map[string]string{
+			"^gorouter\\.": "one_day",
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("gorouter"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("latency"),
+				Value: proto.Float64(5),
+			},
+		})
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("doppler"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("latency"),
+				Value: proto.Float64(7),
+			},
+		})
+
+		err = c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(2))
+		for i, uri := range requestURIs {
+			if uri == "/write?db=testdb&rp=one_day" {
+				Expect(string(bodies[i])).To(Equal("influxdb.nozzle.gorouter.latency value=5 1000000000\n"))
+			} else {
+				Expect(uri).To(Equal("/write?db=testdb"))
+				Expect(string(bodies[i])).To(ContainSubstring("influxdb.nozzle.doppler.latency value=7 1000000000\n"))
+				Expect(string(bodies[i])).ToNot(ContainSubstring("gorouter"))
+			}
+		}
+	})
+
+	It("returns an error for an invalid retention policy pattern", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		err := c.SetRetentionPolicies(map[string]string{
+			"(": "one_day",
+		})
+		Expect(err).To(HaveOccurred())
+	})
+	It("truncates the logged error body to the configured limit", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", testhelpers.Logger())
+		c.SetErrorBodyLogLimit(20)
+		testhelpers.TestLoggerSink.Clear()
+
+		responseCode = http.StatusBadRequest
+		responseBody = []byte(strings.Repeat("0123456789", 10))
+		err := c.PostMetrics()
+		Expect(err).To(HaveOccurred())
+
+		logContents := testhelpers.TestLoggerSink.LogContents()
+		Expect(logContents).To(ContainSubstring("InfluxDB error response body: 01234567890123456789..."))
+		Expect(logContents).ToNot(ContainSubstring("012345678901234567890"))
+	})
+	It("sends the envelope receive rate averaged over the sliding window", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetEmitRuntimeMetrics(true)
+		now := time.Unix(1000, 0)
+		c.SetClock(func() time.Time { return now })
+		c.SetReceiveRateWindow(time.Minute)
+
+		for second := 0; second < 60; second++ {
+			for i := 0; i < 5; i++ {
+				c.AddMetric(&events.Envelope{
+					Origin:    proto.String("origin"),
+					Timestamp: proto.Int64(1000000000),
+					EventType: events.Envelope_LogMessage.Enum(),
+				})
+			}
+			if second < 59 {
+				now = now.Add(time.Second)
+			}
+		}
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.envelopeReceiveRate,ip=dummy-ip,deployment=test-deployment value=5 "))
+	})
+	It("uses the internal metric prefix only for internal metrics", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetEmitRuntimeMetrics(true)
+		c.SetInternalMetricPrefix("nozzle.internal.")
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+		})
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName value=5 1000000000\n"))
+		Expect(string(bodies[0])).To(ContainSubstring("nozzle.internal.totalMessagesReceived,"))
+		Expect(string(bodies[0])).To(ContainSubstring("nozzle.internal.maxTagsPerSeries,"))
+		Expect(string(bodies[0])).ToNot(ContainSubstring("influxdb.nozzle.totalMessagesReceived"))
+	})
+	It("logs a JSON summary after each post", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", testhelpers.Logger())
+		testhelpers.TestLoggerSink.Clear()
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+		})
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+		Eventually(bodies).Should(HaveLen(1))
+
+		var summary influxdbclient.PostSummary
+		for _, line := range strings.Split(testhelpers.TestLoggerSink.LogContents(), "\n") {
+			if strings.HasPrefix(line, "{") {
+				err = json.Unmarshal([]byte(line), &summary)
+				Expect(err).ToNot(HaveOccurred())
+			}
+		}
+
+		lines := strings.Count(string(bodies[0]), "\n")
+		Expect(summary.Series).To(Equal(lines))
+		Expect(summary.Points).To(Equal(lines))
+		Expect(summary.Bytes).To(Equal(len(bodies[0])))
+		Expect(summary.DurationSeconds).To(BeNumerically(">", 0))
+		Expect(summary.Status).To(Equal("200 OK"))
+	})
+	It("skips idle posts when configured to", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetSkipIdlePosts(true)
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bodies).To(BeEmpty())
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+		})
+
+		err = c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bodies).To(HaveLen(1))
+	})
+	It("counts the posts skipped on idle intervals", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetEmitRuntimeMetrics(true)
+		c.SetSkipIdlePosts(true)
+
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(bodies).To(BeEmpty())
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+		})
+
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(bodies).To(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.skippedPosts,ip=dummy-ip,deployment=test-deployment value=2 "))
+	})
+	It("sends the number of distinct deployments seen since the last post", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetEmitRuntimeMetrics(true)
+
+		for _, deployment := range []string{"cf", "diego", "cf", "redis"} {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+				},
+				Deployment: proto.String(deployment),
+			})
+		}
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		err = c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(2))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.distinctDeployments,ip=dummy-ip,deployment=test-deployment value=3 "))
+		Expect(string(bodies[1])).To(ContainSubstring("influxdb.nozzle.distinctDeployments,ip=dummy-ip,deployment=test-deployment value=0 "))
+	})
+	It("sends the number of distinct applications seen since the last post", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetEmitRuntimeMetrics(true)
+		c.SetContainerMetrics(true)
+
+		for _, applicationID := range []string{"app-1", "app-2", "app-1"} {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("rep"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ContainerMetric.Enum(),
+				ContainerMetric: &events.ContainerMetric{
+					ApplicationId: proto.String(applicationID),
+					InstanceIndex: proto.Int32(0),
+					CpuPercentage: proto.Float64(1),
+					MemoryBytes:   proto.Uint64(1),
+					DiskBytes:     proto.Uint64(1),
+				},
+			})
+		}
+
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(bodies).To(HaveLen(2))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.distinctApplications,ip=dummy-ip,deployment=test-deployment value=2 "))
+		Expect(string(bodies[1])).To(ContainSubstring("influxdb.nozzle.distinctApplications,ip=dummy-ip,deployment=test-deployment value=0 "))
+	})
+	Describe("line terminators", func() {
+		var c *influxdbclient.Client
+
+		BeforeEach(func() {
+			c = influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+				},
+			})
+		})
+
+		It("terminates lines with LF by default", func() {
+			err := c.PostMetrics()
+			Expect(err).ToNot(HaveOccurred())
+
+			Eventually(bodies).Should(HaveLen(1))
+			Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName value=5 1000000000\n"))
+			Expect(string(bodies[0])).ToNot(ContainSubstring("\r"))
+		})
+
+		It("terminates lines with the configured terminator", func() {
+			c.SetLineTerminator("\r\n")
+
+			err := c.PostMetrics()
+			Expect(err).ToNot(HaveOccurred())
+
+			Eventually(bodies).Should(HaveLen(1))
+			body := string(bodies[0])
+			Expect(body).To(ContainSubstring("influxdb.nozzle.origin.metricName value=5 1000000000\r\n"))
+			Expect(strings.Count(body, "\n")).To(Equal(strings.Count(body, "\r\n")))
+		})
+	})
+	It("sends the seconds remaining before the UAA token expires", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		now := time.Unix(1000, 0)
+		c.SetClock(func() time.Time { return now })
+		c.SetTokenExpiry(now.Add(600 * time.Second))
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		now = now.Add(100 * time.Second)
+		err = c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(2))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.tokenExpirySeconds,ip=dummy-ip,deployment=test-deployment value=600 "))
+		Expect(string(bodies[1])).To(ContainSubstring("influxdb.nozzle.tokenExpirySeconds,ip=dummy-ip,deployment=test-deployment value=500 "))
+	})
+	It("sends the number of config warnings", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetConfigWarnings(1)
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.configWarnings,ip=dummy-ip,deployment=test-deployment value=1 "))
+	})
+	It("promotes CF space and org tags to standardized tags", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetPromoteCFTags(true)
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+			Tags: map[string]string{
+				"space_name":        "dev",
+				"organization_name": "acme",
+			},
+		})
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName,org=acme,space=dev value=5 1000000000\n"))
+	})
+	It("adds the constant field to every line", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetConstantField("nozzle", "1")
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+		})
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName value=5,nozzle=1 1000000000\n"))
+		lines := strings.Split(strings.TrimSpace(string(bodies[0])), "\n")
+		for _, line := range lines {
+			Expect(line).To(MatchRegexp(` value=[0-9.]+,nozzle=1 [0-9]+$`))
+		}
+	})
+
+	Context("when InfluxDB reports a field type conflict", func() {
+		var c *influxdbclient.Client
+
+		BeforeEach(func() {
+			c = influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+				},
+			})
+
+			responseCode = http.StatusBadRequest
+			responseBody = []byte(`{"error":"partial write: field type conflict: input field \"value\" on measurement \"influxdb.nozzle.origin.metricName\" is type float, already exists as type integer dropped=1"}`)
+		})
+
+		It("returns an error by default", func() {
+			err := c.PostMetrics()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("quarantines the measurement when configured to", func() {
+			c.SetQuarantineConflicts(true)
+			c.SetEmitRuntimeMetrics(true)
+
+			err := c.PostMetrics()
+			Expect(err).ToNot(HaveOccurred())
+
+			responseCode = http.StatusOK
+			responseBody = nil
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(2000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(6),
+				},
+			})
+
+			err = c.PostMetrics()
+			Expect(err).ToNot(HaveOccurred())
+
+			Eventually(bodies).Should(HaveLen(2))
+			Expect(string(bodies[1])).ToNot(ContainSubstring("influxdb.nozzle.origin.metricName"))
+			Expect(string(bodies[1])).To(ContainSubstring("influxdb.nozzle.schemaConflicts,ip=dummy-ip,deployment=test-deployment value=1 "))
+			Expect(string(bodies[1])).To(ContainSubstring("influxdb.nozzle.quarantinedMeasurements,ip=dummy-ip,deployment=test-deployment value=1 "))
+		})
+
+		It("leaves quarantined series out of the tag counts", func() {
+			c.SetQuarantineConflicts(true)
+			c.SetEmitRuntimeMetrics(true)
+
+			err := c.PostMetrics()
+			Expect(err).ToNot(HaveOccurred())
+
+			responseCode = http.StatusOK
+			responseBody = nil
+			c.AddMetric(&events.Envelope{
+				Origin:     proto.String("origin"),
+				Timestamp:  proto.Int64(2000000000),
+				EventType:  events.Envelope_ValueMetric.Enum(),
+				Deployment: proto.String("deployment-name"),
+				Job:        proto.String("doppler"),
+				Index:      proto.String("1"),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(6),
+				},
+			})
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(2000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				Job:       proto.String("doppler"),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("otherMetricName"),
+					Value: proto.Float64(6),
+				},
+			})
+
+			err = c.PostMetrics()
+			Expect(err).ToNot(HaveOccurred())
+
+			Eventually(bodies).Should(HaveLen(2))
+			Expect(string(bodies[1])).ToNot(ContainSubstring("influxdb.nozzle.origin.metricName"))
+			Expect(string(bodies[1])).To(ContainSubstring("influxdb.nozzle.maxTagsPerSeries,ip=dummy-ip,deployment=test-deployment value=1 "))
+			Expect(string(bodies[1])).To(ContainSubstring("influxdb.nozzle.avgTagsPerSeries,ip=dummy-ip,deployment=test-deployment value=1 "))
+		})
+	})
+
+	It("drops and counts lines longer than the maximum line length", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetEmitRuntimeMetrics(true)
+		c.SetMaxLineLength(200)
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+		})
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			Job:       proto.String(strings.Repeat("j", 300)),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("hugeMetric"),
+				Value: proto.Float64(6),
+			},
+		})
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName value=5 1000000000\n"))
+		Expect(string(bodies[0])).ToNot(ContainSubstring("hugeMetric"))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.oversizedLinesDropped,ip=dummy-ip,deployment=test-deployment value=1 "))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.maxTagsPerSeries,ip=dummy-ip,deployment=test-deployment value=0 "))
+	})
+
+	It("writes the batch to both InfluxDB and Datadog when a Datadog sink is set", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetDatadogSink(ts.URL+"/api/v1/series", "secret")
+
+		c.AddMetric(&events.Envelope{
+			Origin:     proto.String("origin"),
+			Timestamp:  proto.Int64(1000000000),
+			EventType:  events.Envelope_ValueMetric.Enum(),
+			Deployment: proto.String("deployment-name"),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+		})
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(2))
+		Expect(requestURIs[0]).To(HavePrefix("/write?"))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName,deployment=deployment-name value=5 1000000000\n"))
+
+		Expect(requestURIs[1]).To(Equal("/api/v1/series?api_key=secret"))
+		var payload datadogclient.Payload
+		err = json.Unmarshal(bodies[1], &payload)
+		Expect(err).NotTo(HaveOccurred())
+
+		var metric datadogclient.Metric
+		for _, m := range payload.Series {
+			if m.Metric == "influxdb.nozzle.origin.metricName" {
+				metric = m
+			}
+		}
+		Expect(metric.Type).To(Equal("gauge"))
+		Expect(metric.Tags).To(ConsistOf("deployment:deployment-name"))
+		Expect(metric.Points).To(Equal([]datadogclient.Point{{Timestamp: 1, Value: 5}}))
+	})
+
+	It("counts Datadog failures without failing the post", func() {
+		datadog := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer datadog.Close()
+
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetDatadogSink(datadog.URL+"/api/v1/series", "secret")
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+		})
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.PendingMetrics()).To(Equal(0))
+
+		err = c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(2))
+		Expect(string(bodies[1])).To(ContainSubstring("influxdb.nozzle.datadogPostFailures,ip=dummy-ip,deployment=test-deployment value=1 "))
+	})
+
+	It("keeps a request body intact until the transport closes it", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		var requestBodies []io.ReadCloser
+		var sentBodies []string
+		influxdbclient.SetHTTPClient(c, &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			snapshot, err := req.GetBody()
+			Expect(err).ToNot(HaveOccurred())
+			sent, err := ioutil.ReadAll(snapshot)
+			Expect(err).ToNot(HaveOccurred())
+			snapshot.Close()
+			sentBodies = append(sentBodies, string(sent))
+
+			// Answer before reading the body, as a server responding early would.
+			requestBodies = append(requestBodies, req.Body)
+			return &http.Response{StatusCode: http.StatusNoContent, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+		})})
+
+		for _, name := range []string{"first", "second"} {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String(name),
+					Value: proto.Float64(5),
+				},
+			})
+			Expect(c.PostMetrics()).To(Succeed())
+		}
+
+		Expect(requestBodies).To(HaveLen(2))
+		first, err := ioutil.ReadAll(requestBodies[0])
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(first)).To(Equal(sentBodies[0]))
+		for _, body := range requestBodies {
+			Expect(body.Close()).To(Succeed())
+		}
+	})
+
+	It("identifies the nozzle version in the User-Agent", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(userAgents).Should(HaveLen(1))
+		Expect(userAgents[0]).To(Equal("influxdb-firehose-nozzle/" + influxdbclient.Version))
+	})
+
+	It("sends the configured User-Agent", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetUserAgent("custom-agent/1.0")
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(userAgents).Should(HaveLen(1))
+		Expect(userAgents[0]).To(Equal("custom-agent/1.0"))
+	})
+
+	It("authenticates with the configured credentials", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(authHeaders).Should(HaveLen(1))
+		Expect(authHeaders[0]).To(HavePrefix("Basic "))
+		credentials, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(authHeaders[0], "Basic "))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(credentials)).To(Equal("user:password"))
+	})
+
+	It("does not authenticate without a user", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "", "", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(authHeaders).Should(HaveLen(1))
+		Expect(authHeaders[0]).To(BeEmpty())
+	})
+
+	It("counts the points dropped after repeated failed posts", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetEmitRuntimeMetrics(true)
+		c.SetDropAfterFailedPosts(2)
+
+		for i := 0; i < 3; i++ {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(int64(i+1) * 1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+				},
+			})
+		}
+
+		responseCode = http.StatusServiceUnavailable
+		Expect(c.PostMetrics()).To(HaveOccurred())
+		Expect(c.PostMetrics()).To(HaveOccurred())
+
+		responseCode = http.StatusOK
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(3))
+		Expect(string(bodies[2])).ToNot(ContainSubstring("influxdb.nozzle.origin.metricName"))
+		Expect(string(bodies[2])).To(ContainSubstring("influxdb.nozzle.pointsDroppedOnFailure,ip=dummy-ip,deployment=test-deployment value=3 "))
+	})
+
+	It("splits metrics with different precisions into separate requests", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		Expect(c.SetPrecision("s")).To(Succeed())
+		Expect(c.SetMeasurementPrecisions(map[string]string{"^origin\\.latency$": "ms"})).To(Succeed())
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1234567890123),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+		})
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1234567890123),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("latency"),
+				Value: proto.Float64(6),
+			},
+		})
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(2))
+		bodiesByURI := make(map[string]string)
+		for i, uri := range requestURIs {
+			bodiesByURI[uri] = string(bodies[i])
+		}
+		Expect(bodiesByURI).To(HaveKey("/write?db=testdb&precision=s"))
+		Expect(bodiesByURI["/write?db=testdb&precision=s"]).To(ContainSubstring("influxdb.nozzle.origin.metricName value=5 1234\n"))
+		Expect(bodiesByURI["/write?db=testdb&precision=s"]).ToNot(ContainSubstring("influxdb.nozzle.origin.latency"))
+		Expect(bodiesByURI).To(HaveKey("/write?db=testdb&precision=ms"))
+		Expect(bodiesByURI["/write?db=testdb&precision=ms"]).To(Equal("influxdb.nozzle.origin.latency value=6 1234567\n"))
+	})
+
+	It("serves the buffered metric keys before they are flushed", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+
+		for i := 0; i < 2; i++ {
+			c.AddMetric(&events.Envelope{
+				Origin:     proto.String("origin"),
+				Timestamp:  proto.Int64(int64(i+1) * 1000000000),
+				EventType:  events.Envelope_ValueMetric.Enum(),
+				Deployment: proto.String("deployment-name"),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+				},
+			})
+		}
+
+		recorder := httptest.NewRecorder()
+		c.ServeBuffer(recorder, &http.Request{})
+
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		var metrics []influxdbclient.BufferedMetric
+		err := json.Unmarshal(recorder.Body.Bytes(), &metrics)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(metrics).To(ConsistOf(influxdbclient.BufferedMetric{
+			Name:   "influxdb.nozzle.origin.metricName",
+			Tags:   []string{"deployment=deployment-name"},
+			Points: 2,
+		}))
+		Expect(bodies).To(BeEmpty())
+	})
+
+	It("skips retries once the retry budget is exhausted and replenishes it over time", func() {
+		now := time.Unix(1000, 0)
+		budget := influxdbclient.NewRetryBudget(2, 1, func() time.Time { return now })
+
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetRetries(5, budget)
+
+		responseCode = http.StatusServiceUnavailable
+		Expect(c.PostMetrics()).To(HaveOccurred())
+		Expect(bodies).To(HaveLen(3))
+
+		Expect(c.PostMetrics()).To(HaveOccurred())
+		Expect(bodies).To(HaveLen(4))
+
+		now = now.Add(time.Second)
+		Expect(c.PostMetrics()).To(HaveOccurred())
+		Expect(bodies).To(HaveLen(6))
+	})
+
+	Context("with a server failing a few times before succeeding", func() {
+		var (
+			flakyServer *httptest.Server
+			failures    int
+			attempts    int
+		)
+
+		BeforeEach(func() {
+			attempts = 0
+			flakyServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts++
+				if attempts <= failures {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				handlePost(w, r)
+			}))
+		})
+
+		AfterEach(func() {
+			flakyServer.Close()
+		})
+
+		It("retries with an exponential backoff until the write succeeds", func() {
+			failures = 3
+			c := influxdbclient.New(flakyServer.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+			c.SetRetries(3, nil)
+			c.SetRetryBackoff(10*time.Millisecond, 15*time.Millisecond)
+
+			start := time.Now()
+			Expect(c.PostMetrics()).To(Succeed())
+
+			Expect(attempts).To(Equal(4))
+			Expect(bodies).To(HaveLen(1))
+			Expect(time.Since(start)).To(BeNumerically(">=", 40*time.Millisecond))
+		})
+
+		It("keeps the buffered metrics when the attempts are exhausted", func() {
+			failures = 3
+			c := influxdbclient.New(flakyServer.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+			c.SetRetries(2, nil)
+			c.SetRetryBackoff(time.Millisecond, time.Millisecond)
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+				},
+			})
+
+			Expect(c.PostMetrics()).To(HaveOccurred())
+			Expect(attempts).To(Equal(3))
+
+			Expect(c.PostMetrics()).To(Succeed())
+			Expect(bodies).To(HaveLen(1))
+			Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName value=5 1000000000\n"))
+		})
+	})
+
+	It("does not retry client errors", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetRetries(5, nil)
+
+		responseCode = http.StatusBadRequest
+		Expect(c.PostMetrics()).To(HaveOccurred())
+		Expect(bodies).To(HaveLen(1))
+	})
+
+	It("only reports the message totals and slow consumer alert without runtime metrics", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+		})
+		c.RecordFlushDrift(time.Second)
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(bodies).To(HaveLen(1))
+		internalPattern := regexp.MustCompile(`(?m)^influxdb\.nozzle\.(\w+)[, ]`)
+		var internal []string
+		for _, match := range internalPattern.FindAllSubmatch(bodies[0], -1) {
+			internal = append(internal, string(match[1]))
+		}
+		Expect(internal).To(ConsistOf("totalMessagesReceived", "totalMetricsSent", "slowConsumerAlert"))
+	})
+
+	It("emits the build info once, on the first post", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetEmitRuntimeMetrics(true)
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+		err = c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(2))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.build_info,ip=dummy-ip,deployment=test-deployment,version=" + influxdbclient.Version + ",commit=" + influxdbclient.Commit + " value=1 "))
+		Expect(string(bodies[1])).ToNot(ContainSubstring("build_info"))
+	})
+
+	It("emits the shutdown reason with the next post only", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.RecordShutdown("fatalError")
+
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(bodies).To(HaveLen(2))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.shutdown,ip=dummy-ip,deployment=test-deployment,reason=fatalError value=1 "))
+		Expect(string(bodies[1])).ToNot(ContainSubstring("shutdown"))
+	})
+
+	It("exposes the totals it reports", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		for _, name := range []string{"metricName", "otherMetricName"} {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String(name),
+					Value: proto.Float64(5),
+				},
+			})
+		}
+		Expect(c.TotalMessagesReceived()).To(BeEquivalentTo(2))
+		Expect(c.TotalMetricsSent()).To(BeZero())
+
+		Expect(c.PostMetrics()).To(Succeed())
+		sent := c.TotalMetricsSent()
+		Expect(sent).To(BeNumerically(">", 2))
+
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(string(bodies[1])).To(ContainSubstring("influxdb.nozzle.totalMessagesReceived,ip=dummy-ip,deployment=test-deployment value=" + strconv.FormatUint(c.TotalMessagesReceived(), 10) + " "))
+		Expect(string(bodies[1])).To(ContainSubstring("influxdb.nozzle.totalMetricsSent,ip=dummy-ip,deployment=test-deployment value=" + strconv.FormatUint(sent, 10) + " "))
+	})
+
+	It("posts every point added while posts and buffer reads run", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+
+		var adders sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			adders.Add(1)
+			go func(i int) {
+				defer adders.Done()
+				for j := 0; j < 50; j++ {
+					c.AddMetric(&events.Envelope{
+						Origin:    proto.String("origin"),
+						Timestamp: proto.Int64(1000000000 + int64(i*1000+j)),
+						EventType: events.Envelope_ValueMetric.Enum(),
+						ValueMetric: &events.ValueMetric{
+							Name:  proto.String("metricName"),
+							Value: proto.Float64(5),
+						},
+					})
+				}
+			}(i)
+		}
+
+		done := make(chan struct{})
+		var readers sync.WaitGroup
+		readers.Add(2)
+		go func() {
+			defer GinkgoRecover()
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				Expect(c.PostMetrics()).To(Succeed())
+			}
+		}()
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				c.BufferedMetrics()
+			}
+		}()
+
+		adders.Wait()
+		close(done)
+		readers.Wait()
+		Expect(c.PostMetrics()).To(Succeed())
+
+		pointPattern := regexp.MustCompile(`(?m)^influxdb\.nozzle\.origin\.metricName `)
+		var points int
+		for _, body := range bodies {
+			points += len(pointPattern.FindAll(body, -1))
+		}
+		Expect(points).To(Equal(200))
+	})
+
+	It("keeps adding metrics while a post is in flight", func() {
+		received := make(chan []byte, 2)
+		unblock := make(chan struct{})
+		blockingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			received <- body
+			<-unblock
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer blockingServer.Close()
+		var release sync.Once
+		defer release.Do(func() { close(unblock) })
+
+		c := influxdbclient.New(blockingServer.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		envelope := func(name string) *events.Envelope {
+			return &events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String(name),
+					Value: proto.Float64(5),
+				},
+			}
+		}
+		c.AddMetric(envelope("before"))
+
+		posted := make(chan error, 1)
+		go func() {
+			posted <- c.PostMetrics()
+		}()
+		var first []byte
+		Eventually(received).Should(Receive(&first))
+		Expect(string(first)).To(ContainSubstring("influxdb.nozzle.origin.before "))
+
+		added := make(chan struct{})
+		go func() {
+			c.AddMetric(envelope("during"))
+			close(added)
+		}()
+		Eventually(added).Should(BeClosed())
+		Expect(c.BufferedPoints()).To(Equal(1))
+
+		release.Do(func() { close(unblock) })
+		Eventually(posted).Should(Receive(BeNil()))
+
+		Expect(c.PostMetrics()).To(Succeed())
+		var second []byte
+		Eventually(received).Should(Receive(&second))
+		Expect(string(second)).To(ContainSubstring("influxdb.nozzle.origin.during "))
+		Expect(string(second)).NotTo(ContainSubstring("influxdb.nozzle.origin.before "))
+	})
+
+	It("drops the oldest series past the buffer byte cap", func() {
+		envelope := func(i int) *events.Envelope {
+			return &events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000 + int64(i)),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName" + strconv.Itoa(i)),
+					Value: proto.Float64(5),
+				},
+			}
+		}
+		uncapped := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		uncapped.AddMetric(envelope(0))
+		seriesSize := uncapped.BufferedBytes()
+		Expect(seriesSize).To(BeNumerically(">", 0))
+
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetMaxBufferBytes(2 * seriesSize)
+		for i := 0; i < 3; i++ {
+			c.AddMetric(envelope(i))
+		}
+
+		Expect(c.BufferedPoints()).To(Equal(2))
+		Expect(c.BufferedBytes()).To(Equal(2 * seriesSize))
+
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(string(bodies[0])).ToNot(ContainSubstring("influxdb.nozzle.origin.metricName0"))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName1"))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName2"))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.pointsDroppedOverBufferCap,ip=dummy-ip,deployment=test-deployment value=1 "))
+	})
+
+	It("reports the metrics sent per message received in the last interval", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetEmitRuntimeMetrics(true)
+		for i := 0; i < 3; i++ {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000 + int64(i)),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+				},
+			})
+		}
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_CounterEvent.Enum(),
+			CounterEvent: &events.CounterEvent{
+				Name:  proto.String("counterName"),
+				Delta: proto.Uint64(1),
+				Total: proto.Uint64(1),
+			},
+		})
+
+		Expect(c.PostMetrics()).To(Succeed())
+		sent := c.TotalMetricsSent()
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(bodies).To(HaveLen(3))
+		Expect(string(bodies[0])).ToNot(ContainSubstring("sentToReceivedRatio"))
+		Expect(string(bodies[1])).To(ContainSubstring("influxdb.nozzle.sentToReceivedRatio,ip=dummy-ip,deployment=test-deployment value=" + strconv.FormatFloat(float64(sent)/4, 'f', -1, 64) + " "))
+		Expect(string(bodies[2])).ToNot(ContainSubstring("sentToReceivedRatio"))
+	})
+
+	It("keeps consistent totals while metrics are added during posts", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+
+		var adders sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			adders.Add(1)
+			go func(i int) {
+				defer adders.Done()
+				for j := 0; j < 50; j++ {
+					c.AddMetric(&events.Envelope{
+						Origin:    proto.String("origin"),
+						Timestamp: proto.Int64(1000000000 + int64(j)),
+						EventType: events.Envelope_ValueMetric.Enum(),
+						ValueMetric: &events.ValueMetric{
+							Name:  proto.String("metricName" + strconv.Itoa(i)),
+							Value: proto.Float64(5),
+						},
+					})
+				}
+			}(i)
+		}
+
+		done := make(chan struct{})
+		posted := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(posted)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				Expect(c.PostMetrics()).To(Succeed())
+				Expect(c.TotalMessagesReceived()).To(BeNumerically("<=", 200))
+			}
+		}()
+
+		adders.Wait()
+		close(done)
+		<-posted
+
+		sent := c.TotalMetricsSent()
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(c.TotalMessagesReceived()).To(BeEquivalentTo(200))
+		Expect(string(bodies[len(bodies)-1])).To(ContainSubstring("influxdb.nozzle.totalMessagesReceived,ip=dummy-ip,deployment=test-deployment value=200 "))
+		Expect(string(bodies[len(bodies)-1])).To(ContainSubstring("influxdb.nozzle.totalMetricsSent,ip=dummy-ip,deployment=test-deployment value=" + strconv.FormatUint(sent, 10) + " "))
+	})
+
+	It("coerces UUID and numeric indexes to a short form", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetIndexFormat(influxdbclient.IndexFormatShort)
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			Index:     proto.String("3A7F9C2E-1B4D-4E6F-8A9B-0C1D2E3F4A5B"),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("uuidMetric"),
+				Value: proto.Float64(5),
+			},
+		})
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			Index:     proto.String("007"),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("numericMetric"),
+				Value: proto.Float64(6),
+			},
+		})
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.uuidMetric,index=3a7f9c2e value=5 1000000000\n"))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.numericMetric,index=7 value=6 1000000000\n"))
+	})
+
+	It("writes counters in the derivative-friendly shape", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetCounterShape(influxdbclient.CounterShapeDerivative)
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_CounterEvent.Enum(),
+			Job:       proto.String("doppler"),
+			Index:     proto.String("1"),
+			CounterEvent: &events.CounterEvent{
+				Name:  proto.String("counterName"),
+				Delta: proto.Uint64(3),
+				Total: proto.Uint64(15),
+			},
+		})
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			Job:       proto.String("doppler"),
+			Index:     proto.String("1"),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+		})
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.counterName,host=doppler/1,index=1,job=doppler value=15,delta=3i 1000000000\n"))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName,index=1,job=doppler value=5 1000000000\n"))
+	})
+
+	It("compacts runs of identical values to their endpoints", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetCompactRepeatedValues(true)
+
+		for i, value := range []float64{1, 5, 5, 5, 5, 2} {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(int64(i + 1)),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(value),
+				},
+			})
+		}
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(1))
+		var lines []string
+		for _, line := range strings.Split(string(bodies[0]), "\n") {
+			if strings.HasPrefix(line, "influxdb.nozzle.origin.metricName ") {
+				lines = append(lines, line)
+			}
+		}
+		Expect(lines).To(Equal([]string{
+			"influxdb.nozzle.origin.metricName value=1 1",
+			"influxdb.nozzle.origin.metricName value=5 2",
+			"influxdb.nozzle.origin.metricName value=5 5",
+			"influxdb.nozzle.origin.metricName value=2 6",
+		}))
+	})
+
+	It("flushes value metrics independently of a longer counter flush interval", func() {
+		now := time.Unix(1000, 0)
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetClock(func() time.Time { return now })
+		c.SetCounterFlushInterval(10 * time.Second)
+
+		addMetrics := func(timestamp int64) {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(timestamp),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+				},
+			})
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(timestamp),
+				EventType: events.Envelope_CounterEvent.Enum(),
+				CounterEvent: &events.CounterEvent{
+					Name:  proto.String("counterName"),
+					Delta: proto.Uint64(1),
+					Total: proto.Uint64(uint64(timestamp)),
+				},
+			})
+		}
+
+		addMetrics(1)
+		Expect(c.PostMetrics()).To(Succeed())
+
+		now = now.Add(time.Second)
+		addMetrics(2)
+		Expect(c.PostMetrics()).To(Succeed())
+
+		now = now.Add(9 * time.Second)
+		addMetrics(3)
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Eventually(bodies).Should(HaveLen(3))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName value=5 1\n"))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.counterName value=1 1\n"))
+
+		Expect(string(bodies[1])).To(ContainSubstring("influxdb.nozzle.origin.metricName value=5 2\n"))
+		Expect(string(bodies[1])).ToNot(ContainSubstring("counterName"))
+
+		Expect(string(bodies[2])).To(ContainSubstring("influxdb.nozzle.origin.metricName value=5 3\n"))
+		Expect(string(bodies[2])).ToNot(ContainSubstring("influxdb.nozzle.origin.metricName value=5 2\n"))
+		Expect(string(bodies[2])).To(ContainSubstring("influxdb.nozzle.origin.counterName value=2 2\ninfluxdb.nozzle.origin.counterName value=3 3\n"))
+	})
+
+	It("reports the goroutine count when runtime metrics are enabled", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetEmitRuntimeMetrics(true)
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(1))
+		match := regexp.MustCompile(`influxdb\.nozzle\.goroutines,ip=dummy-ip,deployment=test-deployment value=([0-9]+) `).FindSubmatch(bodies[0])
+		Expect(match).ToNot(BeNil())
+		goroutines, err := strconv.Atoi(string(match[1]))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(goroutines).To(BeNumerically(">", 0))
+		Expect(goroutines).To(BeNumerically("<", 10000))
+	})
+
+	It("appends the measurement suffix to firehose metrics", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetMeasurementSuffix("_total")
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_CounterEvent.Enum(),
+			CounterEvent: &events.CounterEvent{
+				Name:  proto.String("counterName"),
+				Delta: proto.Uint64(1),
+				Total: proto.Uint64(15),
+			},
+		})
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.counterName_total value=15 1000000000\n"))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.totalMessagesReceived,"))
+	})
+
+	It("reports firehose consumer errors per category", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetEmitRuntimeMetrics(true)
+
+		c.RecordConsumerError("auth")
+		c.RecordConsumerError("network")
+		c.RecordConsumerError("auth")
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.firehoseErrors.auth,ip=dummy-ip,deployment=test-deployment value=2 "))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.firehoseErrors.network,ip=dummy-ip,deployment=test-deployment value=1 "))
+		Expect(string(bodies[0])).ToNot(ContainSubstring("firehoseErrors.slowConsumer"))
+	})
+
+	It("keeps a deterministic subset of tags when capping tags per series", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetMaxTagsPerSeries(3)
+
+		for i := 0; i < 5; i++ {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(int64(i + 1)),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				Job:       proto.String("doppler"),
+				Tags: map[string]string{
+					"zone":     "z1",
+					"app":      "web",
+					"protocol": "http",
+					"env":      "prod",
+				},
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+				},
+			})
+		}
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(1))
+		for i := 1; i <= 5; i++ {
+			Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName,app=web,env=prod,job=doppler value=5 %d\n", i))
+		}
+	})
+
+	It("caps the tags added for HttpStartStop envelopes too, keeping the static tags", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetHttpMetrics(true)
+		c.SetMaxTagsPerSeries(2)
+		c.SetStaticTags(map[string]string{"env": "prod"})
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("gorouter"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_HttpStartStop.Enum(),
+			Job:       proto.String("router"),
+			HttpStartStop: &events.HttpStartStop{
+				StartTimestamp: proto.Int64(1000000000),
+				StopTimestamp:  proto.Int64(1012500000),
+				PeerType:       events.PeerType_Client.Enum(),
+				Method:         events.Method_GET.Enum(),
+				StatusCode:     proto.Int32(200),
+			},
+		})
+
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(bodies).To(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.gorouter.http_latency_ms,env=prod,job=router,method=GET value=12.5 1000000000\n"))
+	})
+
+	It("reports the total marshaled size of the envelopes received", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetEmitRuntimeMetrics(true)
+
+		envelope := &events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+				Unit:  proto.String("ms"),
+			},
+		}
+		marshaled, err := proto.Marshal(envelope)
+		Expect(err).ToNot(HaveOccurred())
+
+		c.AddMetric(envelope)
+		c.AddMetric(envelope)
+
+		err = c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.totalBytesReceived,ip=dummy-ip,deployment=test-deployment value=%d ", 2*len(marshaled)))
+	})
+
+	It("ignores a nil envelope", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+
+		Expect(func() { c.AddMetric(nil) }).NotTo(Panic())
+		Expect(c.TotalMessagesReceived()).To(BeZero())
+		Expect(c.BufferedPoints()).To(Equal(0))
+	})
+
+	It("aborts a post which exceeds the write timeout", func() {
+		release := make(chan struct{})
+		slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		defer slowServer.Close()
+		defer close(release)
+
+		c := influxdbclient.New(slowServer.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetWriteTimeout(200 * time.Millisecond)
+
+		start := time.Now()
+		err := c.PostMetrics()
+		Expect(err).To(HaveOccurred())
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+	})
+
+	It("redacts the values of sensitive tags", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetRedactedTags([]string{"auth_token", "ip"}, influxdbclient.RedactionMask)
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			Ip:        proto.String("10.0.1.2"),
+			Tags: map[string]string{
+				"auth_token": "s3cr3t",
+				"protocol":   "http",
+			},
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+		})
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName,auth_token=REDACTED,ip=REDACTED,protocol=http value=5 1000000000\n"))
+		Expect(string(bodies[0])).ToNot(ContainSubstring("s3cr3t"))
+	})
+
+	It("matches redacted tags by the name they are written with", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetTagNames(map[string]string{"ip": "host_ip"})
+		c.SetPromoteCFTags(true)
+		c.SetRedactedTags([]string{"host_ip", "space", "job"}, influxdbclient.RedactionMask)
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			Ip:        proto.String("10.0.1.2"),
+			Tags: map[string]string{
+				"space_name": "secret-space",
+				"job":        "secret-job",
+			},
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+		})
+
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(bodies).To(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName,host_ip=REDACTED,job=REDACTED,space=REDACTED value=5 1000000000\n"))
+		Expect(string(bodies[0])).ToNot(ContainSubstring("10.0.1.2"))
+		Expect(string(bodies[0])).ToNot(ContainSubstring("secret"))
+	})
+
+	It("replaces the values of sensitive tags by a hash when configured to", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetRedactedTags([]string{"auth_token"}, influxdbclient.RedactionHash)
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			Tags: map[string]string{
+				"auth_token": "s3cr3t",
+			},
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+		})
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(1))
+		Expect(string(bodies[0])).To(MatchRegexp(`influxdb\.nozzle\.origin\.metricName,auth_token=[0-9a-f]{16} value=5 1000000000\n`))
+		Expect(string(bodies[0])).ToNot(ContainSubstring("s3cr3t"))
+	})
+
+	It("counts the retries performed", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetEmitRuntimeMetrics(true)
+		c.SetRetries(2, nil)
+
+		responseCode = http.StatusServiceUnavailable
+		Expect(c.PostMetrics()).To(HaveOccurred())
+		Expect(bodies).To(HaveLen(3))
+
+		responseCode = http.StatusOK
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(bodies).To(HaveLen(4))
+		Expect(string(bodies[3])).To(ContainSubstring("influxdb.nozzle.postRetries,ip=dummy-ip,deployment=test-deployment value=2 "))
+	})
+
+	Context("with an empty metric name", func() {
+		var c *influxdbclient.Client
+
+		BeforeEach(func() {
+			c = influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+			c.SetEmitRuntimeMetrics(true)
+		})
+
+		addEmptyNameMetric := func() {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String(""),
+					Value: proto.Float64(5),
+				},
+			})
+		}
+
+		It("skips the metric when configured to", func() {
+			c.SetEmptyNamePolicy(influxdbclient.EmptyNameSkip)
+			addEmptyNameMetric()
+
+			err := c.PostMetrics()
+			Expect(err).ToNot(HaveOccurred())
+
+			Eventually(bodies).Should(HaveLen(1))
+			Expect(string(bodies[0])).ToNot(ContainSubstring("influxdb.nozzle.origin."))
+			Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.emptyMetricNames,ip=dummy-ip,deployment=test-deployment value=1 "))
+		})
+
+		It("substitutes a placeholder when configured to", func() {
+			c.SetEmptyNamePolicy(influxdbclient.EmptyNamePlaceholder)
+			addEmptyNameMetric()
+
+			err := c.PostMetrics()
+			Expect(err).ToNot(HaveOccurred())
+
+			Eventually(bodies).Should(HaveLen(1))
+			Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.unknown value=5 1000000000\n"))
+			Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.emptyMetricNames,ip=dummy-ip,deployment=test-deployment value=1 "))
+		})
+	})
+
+	It("asks for gzipped responses and decodes them", func() {
+		var acceptEncodings []string
+		gzipServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			acceptEncodings = append(acceptEncodings, r.Header.Get("Accept-Encoding"))
+			w.Header().Set("Content-Encoding", "gzip")
+			w.WriteHeader(http.StatusBadRequest)
+			writer := gzip.NewWriter(w)
+			io.WriteString(writer, `{"error":"unable to parse points"}`)
+			writer.Close()
+		}))
+		defer gzipServer.Close()
+
+		c := influxdbclient.New(gzipServer.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetAcceptGzip(true)
+
+		err := c.PostMetrics()
+		Expect(acceptEncodings).To(Equal([]string{"gzip"}))
+		var writeErr *influxdbclient.WriteError
+		Expect(errors.As(err, &writeErr)).To(BeTrue())
+		Expect(writeErr.Body).To(Equal(`{"error":"unable to parse points"}`))
+	})
+
+	It("writes line protocol datagrams to a UDP listener", func() {
+		listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		Expect(c.SetUDP(listener.LocalAddr().String(), 256)).To(Succeed())
+		for i := 0; i < 10; i++ {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName" + strconv.Itoa(i)),
+					Value: proto.Float64(5),
+				},
+			})
+		}
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(bodies).To(BeEmpty())
+
+		var lines []string
+		datagram := make([]byte, 65536)
+		for {
+			listener.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+			n, _, err := listener.ReadFrom(datagram)
+			if err != nil {
+				break
+			}
+			Expect(n).To(BeNumerically("<=", 256))
+			Expect(datagram[n-1]).To(BeEquivalentTo('\n'))
+			lines = append(lines, strings.Split(strings.TrimSuffix(string(datagram[:n]), "\n"), "\n")...)
+		}
+
+		for _, line := range lines {
+			Expect(line).To(MatchRegexp(`^[^ ]+ value=[^ ]+ [0-9]+$`))
+		}
+		for i := 0; i < 10; i++ {
+			Expect(lines).To(ContainElement("influxdb.nozzle.origin.metricName" + strconv.Itoa(i) + " value=5 1000000000"))
+		}
+		Expect(lines).To(ContainElement(HavePrefix("influxdb.nozzle.totalMessagesReceived,")))
+	})
+
+	It("splits datagrams on the configured line terminator", func() {
+		listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetLineTerminator("\r")
+		Expect(c.SetUDP(listener.LocalAddr().String(), 128)).To(Succeed())
+		for i := 0; i < 10; i++ {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName" + strconv.Itoa(i)),
+					Value: proto.Float64(5),
+				},
+			})
+		}
+		Expect(c.PostMetrics()).To(Succeed())
+
+		var lines []string
+		datagram := make([]byte, 65536)
+		for {
+			listener.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+			n, _, err := listener.ReadFrom(datagram)
+			if err != nil {
+				break
+			}
+			Expect(n).To(BeNumerically("<=", 128))
+			Expect(string(datagram[:n])).To(HaveSuffix("\r"))
+			lines = append(lines, strings.Split(strings.TrimSuffix(string(datagram[:n]), "\r"), "\r")...)
+		}
+
+		for _, line := range lines {
+			Expect(line).To(MatchRegexp(`^[^ \r\n]+ value=[^ ]+ [0-9]+$`))
+		}
+		for i := 0; i < 10; i++ {
+			Expect(lines).To(ContainElement("influxdb.nozzle.origin.metricName" + strconv.Itoa(i) + " value=5 1000000000"))
+		}
+	})
+
+	It("writes uncompressed datagrams even when gzip is enabled", func() {
+		listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		Expect(c.SetGzip(true, 5)).To(Succeed())
+		Expect(c.SetUDP(listener.LocalAddr().String(), 0)).To(Succeed())
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+		})
+		Expect(c.PostMetrics()).To(Succeed())
+
+		var received string
+		datagram := make([]byte, 65536)
+		for {
+			listener.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+			n, _, err := listener.ReadFrom(datagram)
+			if err != nil {
+				break
+			}
+			received += string(datagram[:n])
+		}
+		Expect(received).To(ContainSubstring("influxdb.nozzle.origin.metricName value=5 1000000000\n"))
+	})
+
+	It("writes the legacy JSON format when configured to", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetWriteFormat(influxdbclient.WriteFormatJSON)
+		c.SetEnvelopeFieldMapping(map[string]string{"job": "field"})
+
+		c.AddMetric(&events.Envelope{
+			Origin:     proto.String("origin"),
+			Timestamp:  proto.Int64(1000000000),
+			EventType:  events.Envelope_ValueMetric.Enum(),
+			Deployment: proto.String("deployment-name"),
+			Job:        proto.String("doppler"),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+		})
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(1))
+		var payload struct {
+			Database string `json:"database"`
+			Points   []struct {
+				Measurement string                 `json:"measurement"`
+				Tags        map[string]string      `json:"tags"`
+				Time        int64                  `json:"time"`
+				Fields      map[string]interface{} `json:"fields"`
+			} `json:"points"`
+		}
+		err = json.Unmarshal(bodies[0], &payload)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(payload.Database).To(Equal("testdb"))
+
+		var found bool
+		for _, point := range payload.Points {
+			if point.Measurement == "influxdb.nozzle.origin.metricName" {
+				found = true
+				Expect(point.Tags).To(Equal(map[string]string{"deployment": "deployment-name"}))
+				Expect(point.Time).To(Equal(int64(1000000000)))
+				Expect(point.Fields).To(Equal(map[string]interface{}{"value": 5.0, "job": "doppler"}))
+			}
+		}
+		Expect(found).To(BeTrue())
+	})
+
+	It("compresses writes with the configured gzip level", func() {
+		postCompressed := func(level int) []byte {
+			bodies = nil
+			c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+			Expect(c.SetGzip(true, level)).To(Succeed())
+			for i := 0; i < 200; i++ {
+				c.AddMetric(&events.Envelope{
+					Origin:    proto.String("origin"),
+					Timestamp: proto.Int64(int64(i)),
+					EventType: events.Envelope_ValueMetric.Enum(),
+					ValueMetric: &events.ValueMetric{
+						Name:  proto.String("metricName" + strconv.Itoa(i%7)),
+						Value: proto.Float64(float64(i * i)),
+					},
+				})
+			}
+			Expect(c.PostMetrics()).To(Succeed())
+			Expect(bodies).To(HaveLen(1))
+			return bodies[0]
+		}
+
+		none := postCompressed(gzip.NoCompression)
+		best := postCompressed(gzip.BestCompression)
+		Expect(len(best)).To(BeNumerically("<", len(none)))
+
+		reader, err := gzip.NewReader(bytes.NewReader(best))
+		Expect(err).ToNot(HaveOccurred())
+		body, err := ioutil.ReadAll(reader)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(body)).To(ContainSubstring("influxdb.nozzle.origin.metricName0 value=0 0\n"))
+
+		Expect(influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log).SetGzip(true, 42)).ToNot(Succeed())
+		Expect(influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log).SetGzip(true, gzip.HuffmanOnly-1)).ToNot(Succeed())
+		Expect(influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log).SetGzip(true, gzip.HuffmanOnly)).To(Succeed())
+	})
+
+	It("reports the number of distinct metrics waiting for the next post", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+
+		for _, name := range []string{"metricA", "metricB", "metricA"} {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String(name),
+					Value: proto.Float64(5),
+				},
+			})
+		}
+		Expect(c.PendingMetrics()).To(Equal(2))
+
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(c.PendingMetrics()).To(Equal(0))
+	})
+
+	It("starts every post from an empty body", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+
+		for _, name := range []string{"firstMetric", "secondMetric"} {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String(name),
+					Value: proto.Float64(5),
+				},
+			})
+			Expect(c.PostMetrics()).To(Succeed())
+		}
+
+		Expect(bodies).To(HaveLen(2))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.firstMetric "))
+		Expect(string(bodies[1])).To(ContainSubstring("influxdb.nozzle.origin.secondMetric "))
+		Expect(string(bodies[1])).ToNot(ContainSubstring("firstMetric"))
+		Expect(strings.Count(string(bodies[1]), "influxdb.nozzle.totalMessagesReceived,")).To(Equal(1))
+	})
+
+	It("sends line protocol as plain text", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(c.SetGzip(true, gzip.DefaultCompression)).To(Succeed())
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(contentTypes).To(Equal([]string{"text/plain; charset=utf-8", "text/plain; charset=utf-8"}))
+	})
+
+	It("round-trips the line protocol through a gzipped write", func() {
+		var received []string
+		var lock sync.Mutex
+		gzipServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var reader io.Reader = r.Body
+			if r.Header.Get("Content-Encoding") == "gzip" {
+				reader, _ = gzip.NewReader(r.Body)
+			}
+			body, _ := ioutil.ReadAll(reader)
+			lock.Lock()
+			received = append(received, string(body))
+			lock.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer gzipServer.Close()
+
+		post := func(compressed bool) []string {
+			c := influxdbclient.New(gzipServer.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+			c.SetClock(func() time.Time { return time.Unix(1000, 0) })
+			Expect(c.SetGzip(compressed, gzip.DefaultCompression)).To(Succeed())
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+				},
+				Tags: map[string]string{"space_name": "dev"},
+			})
+			Expect(c.PostMetrics()).To(Succeed())
+
+			lock.Lock()
+			defer lock.Unlock()
+			return strings.SplitAfter(received[len(received)-1], "\n")
+		}
+
+		plain := post(false)
+		Expect(post(true)).To(ConsistOf(plain))
+		Expect(plain).To(ContainElement("influxdb.nozzle.origin.metricName,space_name=dev value=5 1000000000\n"))
+	})
+
+	Describe("with a line limit per request", func() {
+		addMetrics := func(c *influxdbclient.Client, count int) {
+			for i := 0; i < count; i++ {
+				c.AddMetric(&events.Envelope{
+					Origin:    proto.String("origin"),
+					Timestamp: proto.Int64(1000000000),
+					EventType: events.Envelope_ValueMetric.Enum(),
+					ValueMetric: &events.ValueMetric{
+						Name:  proto.String("metricName" + strconv.Itoa(i)),
+						Value: proto.Float64(5),
+					},
+				})
+			}
+		}
+		metricLines := regexp.MustCompile(`(?m)^influxdb\.nozzle\.origin\.metricName`)
+
+		It("splits a post into several writes", func() {
+			c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+			c.SetMaxLinesPerRequest(10)
+			addMetrics(c, 50)
+
+			Expect(c.PostMetrics()).To(Succeed())
+
+			Expect(len(bodies)).To(BeNumerically(">=", 5))
+			var lines int
+			for _, body := range bodies {
+				lines += len(metricLines.FindAll(body, -1))
+			}
+			Expect(lines).To(Equal(50))
+		})
+
+		It("keeps only the unsent points when a write fails part way", func() {
+			var requests int
+			var sent [][]byte
+			var lock sync.Mutex
+			flakyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				lock.Lock()
+				defer lock.Unlock()
+				requests++
+				if requests == 2 {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				sent = append(sent, body)
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer flakyServer.Close()
+
+			c := influxdbclient.New(flakyServer.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+			c.SetMaxLinesPerRequest(10)
+			addMetrics(c, 50)
+
+			Expect(c.PostMetrics()).ToNot(Succeed())
+			Expect(c.BufferedPoints()).To(BeNumerically("<", 50))
+			Expect(c.PostMetrics()).To(Succeed())
+			Expect(c.BufferedPoints()).To(Equal(0))
+
+			lock.Lock()
+			defer lock.Unlock()
+			var lines int
+			for _, body := range sent {
+				lines += len(metricLines.FindAll(body, -1))
+			}
+			Expect(lines).To(Equal(50))
+		})
+	})
+
+	It("reports the age of the oldest unsent batch while posts fail", func() {
+		now := time.Unix(1000, 0)
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetEmitRuntimeMetrics(true)
+		c.SetClock(func() time.Time { return now })
+
+		responseCode = http.StatusServiceUnavailable
+		Expect(c.PostMetrics()).To(HaveOccurred())
+		now = now.Add(5 * time.Second)
+		Expect(c.PostMetrics()).To(HaveOccurred())
+
+		responseCode = http.StatusOK
+		now = now.Add(5 * time.Second)
+		Expect(c.PostMetrics()).To(Succeed())
+		now = now.Add(5 * time.Second)
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(bodies).To(HaveLen(4))
+		for i, age := range []int{0, 5, 10, 0} {
+			Expect(string(bodies[i])).To(ContainSubstring("influxdb.nozzle.oldestUnsentBatchAgeSeconds,ip=dummy-ip,deployment=test-deployment value=%d ", age))
+		}
+	})
+
+	It("writes each buffered point of a series on its own line with its own timestamp", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+
+		for i, value := range []float64{5, 76} {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(int64(i+1) * 1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(value),
+				},
+			})
+		}
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName value=5 1000000000\ninfluxdb.nozzle.origin.metricName value=76 2000000000\n"))
+		Expect(string(bodies[0])).ToNot(ContainSubstring("value=5,value=76"))
+	})
+
+	It("drops the event types not allowed for a deployment", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		Expect(c.SetDeploymentEventTypes(map[string][]string{"noisy": {"ValueMetric"}})).To(Succeed())
+
+		for _, deployment := range []string{"noisy", "quiet"} {
+			c.AddMetric(&events.Envelope{
+				Origin:     proto.String(deployment),
+				Timestamp:  proto.Int64(1000000000),
+				EventType:  events.Envelope_CounterEvent.Enum(),
+				Deployment: proto.String(deployment),
+				CounterEvent: &events.CounterEvent{
+					Name:  proto.String("counterName"),
+					Delta: proto.Uint64(1),
+					Total: proto.Uint64(15),
+				},
+			})
+			c.AddMetric(&events.Envelope{
+				Origin:     proto.String(deployment),
+				Timestamp:  proto.Int64(1000000000),
+				EventType:  events.Envelope_ValueMetric.Enum(),
+				Deployment: proto.String(deployment),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+				},
+			})
+		}
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(1))
+		Expect(string(bodies[0])).ToNot(ContainSubstring("influxdb.nozzle.noisy.counterName"))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.noisy.metricName,deployment=noisy value=5 "))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.quiet.counterName,deployment=quiet value=15 "))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.quiet.metricName,deployment=quiet value=5 "))
+
+		Expect(c.SetDeploymentEventTypes(map[string][]string{"noisy": {"Bogus"}})).ToNot(Succeed())
+	})
+
+	It("writes no tags beyond the envelope's for a basic value metric", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+		})
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName value=5 1000000000\n"))
+		Expect(string(bodies[0])).ToNot(ContainSubstring("potato"))
+	})
+
+	Context("with a TLS server using a self-signed certificate", func() {
+		var tlsServer *httptest.Server
+
+		BeforeEach(func() {
+			tlsServer = httptest.NewTLSServer(http.HandlerFunc(handlePost))
+		})
+
+		AfterEach(func() {
+			tlsServer.Close()
+		})
+
+		It("fails certificate verification when self-signed certificates aren't allowed", func() {
+			c := influxdbclient.New(tlsServer.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+
+			err := c.PostMetrics()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("certificate"))
+			Expect(bodies).To(BeEmpty())
+		})
+
+		It("posts when self-signed certificates are allowed", func() {
+			c := influxdbclient.New(tlsServer.URL, "testdb", "user", "password", true, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+
+			err := c.PostMetrics()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bodies).To(HaveLen(1))
+		})
+
+		Context("reached through a host the certificate isn't issued for", func() {
+			var c *influxdbclient.Client
+
+			BeforeEach(func() {
+				port := tlsServer.URL[strings.LastIndex(tlsServer.URL, ":"):]
+				c = influxdbclient.New("https://influxdb.internal"+port, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+
+				roots := x509.NewCertPool()
+				roots.AddCert(tlsServer.Certificate())
+				c.SetRootCAs(roots)
+
+				dialer := &net.Dialer{}
+				c.SetDial(func(ctx context.Context, network, address string) (net.Conn, error) {
+					return dialer.DialContext(ctx, network, tlsServer.Listener.Addr().String())
+				})
+			})
+
+			It("fails verification", func() {
+				err := c.PostMetrics()
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("influxdb.internal"))
+				Expect(bodies).To(BeEmpty())
+			})
+
+			It("verifies the certificate against the overridden server name", func() {
+				c.SetTLSServerName("example.com")
+
+				err := c.PostMetrics()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(bodies).To(HaveLen(1))
+			})
+		})
+	})
+
+	It("reports the distinct tag sets buffered per measurement", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetTagSetReportInterval(time.Minute)
+
+		for _, job := range []string{"doppler", "router", "doppler"} {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				Job:       proto.String(job),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+				},
+			})
+		}
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("otherMetric"),
+				Value: proto.Float64(5),
+			},
+		})
+
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(bodies).To(HaveLen(2))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.distinctTagSets,ip=dummy-ip,deployment=test-deployment,measurement=influxdb.nozzle.origin.metricName value=2 "))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.distinctTagSets,ip=dummy-ip,deployment=test-deployment,measurement=influxdb.nozzle.origin.otherMetric value=1 "))
+		Expect(string(bodies[1])).ToNot(ContainSubstring("distinctTagSets"))
+	})
+
+	It("retries a write whose host failed to resolve", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetRetries(1, nil)
+		c.SetDNSRetryDelay(time.Millisecond)
+
+		var dials int
+		dialer := &net.Dialer{}
+		c.SetDial(func(ctx context.Context, network, address string) (net.Conn, error) {
+			dials++
+			if dials == 1 {
+				return nil, &net.DNSError{Err: "no such host", Name: "influxdb", IsTemporary: true}
+			}
+			return dialer.DialContext(ctx, network, address)
+		})
+
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(dials).To(Equal(2))
+		Expect(bodies).To(HaveLen(1))
+	})
+
+	It("reuses connections across posts", func() {
+		var newConns int
+		keepAliveServer := httptest.NewUnstartedServer(http.HandlerFunc(handlePost))
+		keepAliveServer.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				newConns++
+			}
+		}
+		keepAliveServer.Start()
+		defer keepAliveServer.Close()
+
+		c := influxdbclient.New(keepAliveServer.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		for i := 0; i < 3; i++ {
+			Expect(c.PostMetrics()).To(Succeed())
+		}
+
+		Expect(bodies).To(HaveLen(3))
+		Expect(newConns).To(Equal(1))
+	})
+
+	Context("with a source_id envelope tag", func() {
+		var envelope *events.Envelope
+
+		BeforeEach(func() {
+			envelope = &events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+				},
+				Tags: map[string]string{"source_id": "app-guid"},
+			}
+		})
+
+		It("writes it as a source_id tag", func() {
+			c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+			c.AddMetric(envelope)
+
+			Expect(c.PostMetrics()).To(Succeed())
+
+			Expect(bodies).To(HaveLen(1))
+			Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName,source_id=app-guid value=5 1000000000\n"))
+		})
+
+		It("omits it when disabled", func() {
+			c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+			c.SetSourceIDTag(false)
+			c.AddMetric(envelope)
+
+			Expect(c.PostMetrics()).To(Succeed())
+
+			Expect(bodies).To(HaveLen(1))
+			Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName value=5 1000000000\n"))
+		})
+	})
+
+	Context("writing to InfluxDB 1.x", func() {
+		It("uses the database write URL and basic auth", func() {
+			c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+			c.SetRetentionPolicies(map[string]string{".*": "weekly"})
+			Expect(c.SetPrecision("u")).To(Succeed())
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+				},
+			})
+
+			Expect(c.PostMetrics()).To(Succeed())
+
+			Expect(requestURIs).To(ConsistOf("/write?db=testdb&rp=weekly&precision=u", "/write?db=testdb&precision=u"))
+			Expect(authHeaders[0]).To(HavePrefix("Basic "))
+		})
+	})
+
+	Context("writing to InfluxDB 2.x", func() {
+		It("uses the v2 write URL and the API token", func() {
+			c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+			c.SetAPIV2("my org", "secret-token")
+			c.SetRetentionPolicies(map[string]string{".*": "weekly"})
+			Expect(c.SetPrecision("u")).To(Succeed())
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+				},
+			})
+
+			Expect(c.PostMetrics()).To(Succeed())
+
+			Expect(requestURIs).To(ConsistOf("/api/v2/write?org=my+org&bucket=testdb%2Fweekly&precision=us", "/api/v2/write?org=my+org&bucket=testdb&precision=us"))
+			Expect(authHeaders).To(Equal([]string{"Token secret-token", "Token secret-token"}))
+		})
+
+		It("uses the database as the bucket without a retention policy", func() {
+			c := influxdbclient.New(ts.URL, "testdb", "", "", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+			c.SetAPIV2("org", "secret-token")
+
+			Expect(c.PostMetrics()).To(Succeed())
+
+			Expect(requestURIs).To(Equal([]string{"/api/v2/write?org=org&bucket=testdb"}))
+		})
+	})
+
+	It("escapes line protocol characters in tags", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+			Tags: map[string]string{
+				"path":        "/v2/apps?foo=bar baz",
+				"request,key": "a,b",
+			},
+		})
+
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(bodies).To(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring(`influxdb.nozzle.origin.metricName,path=/v2/apps?foo\=bar\ baz,request\,key=a\,b value=5 1000000000` + "\n"))
+
+		escaped := `(?:[^,= \\]|\\[,= ])+`
+		linePattern := `^[^ ,]+(?:,` + escaped + `=` + escaped + `)* value=\S+ \d+$`
+		for _, line := range strings.Split(strings.TrimSpace(string(bodies[0])), "\n") {
+			Expect(line).To(MatchRegexp(linePattern))
+		}
+	})
+
+	It("escapes equals signs in tag keys", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+			Tags: map[string]string{
+				"a=b": "c",
+			},
+		})
+
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(bodies).To(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring(`influxdb.nozzle.origin.metricName,a\=b=c value=5 1000000000` + "\n"))
+	})
+
+	It("escapes line protocol characters in measurement names", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "", "test-deployment", "dummy-ip", log)
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("my origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metric,Name"),
+				Value: proto.Float64(5),
+			},
+		})
+
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(bodies).To(HaveLen(1))
+		Expect(string(bodies[0])).To(MatchRegexp(`(?m)^my\\ origin\.metric\\,Name value=5 1000000000$`))
+	})
+
+	It("keeps counter totals continuous across posts and instance restarts", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetResetSafeCounters(true)
+
+		addCounter := func(total uint64) {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(int64(total)),
+				EventType: events.Envelope_CounterEvent.Enum(),
+				Job:       proto.String("router"),
+				Index:     proto.String("0"),
+				CounterEvent: &events.CounterEvent{
+					Name:  proto.String("requests"),
+					Delta: proto.Uint64(1),
+					Total: proto.Uint64(total),
+				},
+			})
+		}
+
+		addCounter(10)
+		addCounter(15)
+		Expect(c.PostMetrics()).To(Succeed())
+
+		addCounter(3)
+		addCounter(5)
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(bodies).To(HaveLen(2))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.requests,index=0,job=router value=15 15\n"))
+		Expect(string(bodies[1])).To(ContainSubstring("influxdb.nozzle.origin.requests,index=0,job=router value=18 3\n"))
+		Expect(string(bodies[1])).To(ContainSubstring("influxdb.nozzle.origin.requests,index=0,job=router value=20 5\n"))
+	})
+
+	It("writes coherent second-precision timestamps for firehose and internal metrics", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetClock(func() time.Time { return time.Unix(1500, 999) })
+		Expect(c.SetPrecision("s")).To(Succeed())
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1234567890123),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+		})
+
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(requestURIs).To(Equal([]string{"/write?db=testdb&precision=s"}))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName value=5 1234\n"))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.totalMessagesReceived,ip=dummy-ip,deployment=test-deployment value=1 1500\n"))
+	})
+
+	It("sums the configured metrics across the instances of each job", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetJobAggregates([]string{"rep.CapacityRemainingMemory"})
+
+		reports := []struct {
+			job   string
+			index string
+			value float64
+		}{
+			{"diego-cell", "0", 100},
+			{"diego-cell", "1", 250},
+			{"diego-cell", "0", 150},
+			{"diego-cell-isolated", "0", 1000},
+		}
+		for _, report := range reports {
+			c.AddMetric(&events.Envelope{
+				Origin:     proto.String("rep"),
+				Timestamp:  proto.Int64(1000000000),
+				EventType:  events.Envelope_ValueMetric.Enum(),
+				Deployment: proto.String("cf"),
+				Job:        proto.String(report.job),
+				Index:      proto.String(report.index),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("CapacityRemainingMemory"),
+					Value: proto.Float64(report.value),
+				},
+			})
+		}
+		c.AddMetric(&events.Envelope{
+			Origin:     proto.String("rep"),
+			Timestamp:  proto.Int64(1000000000),
+			EventType:  events.Envelope_ValueMetric.Enum(),
+			Deployment: proto.String("cf"),
+			Job:        proto.String("diego-cell"),
+			Index:      proto.String("0"),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("ContainerCount"),
+				Value: proto.Float64(3),
+			},
+		})
+
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(bodies).To(HaveLen(2))
+		Expect(string(bodies[0])).To(MatchRegexp(`influxdb\.nozzle\.rep\.CapacityRemainingMemory\.job_total,deployment=cf,job=diego-cell value=400 [0-9]+\n`))
+		Expect(string(bodies[0])).To(MatchRegexp(`influxdb\.nozzle\.rep\.CapacityRemainingMemory\.job_total,deployment=cf,job=diego-cell-isolated value=1000 [0-9]+\n`))
+		Expect(string(bodies[0])).ToNot(ContainSubstring("ContainerCount.job_total"))
+		Expect(string(bodies[1])).ToNot(ContainSubstring("job_total"))
+	})
+
+	It("writes job totals with the firehose prefix and suffix", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "cf.", "test-deployment", "dummy-ip", log)
+		c.SetInternalMetricPrefix("nozzle.")
+		c.SetMeasurementSuffix("_x")
+		c.SetJobAggregates([]string{"rep.CapacityRemainingMemory"})
+
+		c.AddMetric(&events.Envelope{
+			Origin:     proto.String("rep"),
+			Timestamp:  proto.Int64(1000000000),
+			EventType:  events.Envelope_ValueMetric.Enum(),
+			Deployment: proto.String("cf"),
+			Job:        proto.String("diego-cell"),
+			Index:      proto.String("0"),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("CapacityRemainingMemory"),
+				Value: proto.Float64(100),
+			},
+		})
+
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(bodies).To(HaveLen(1))
+		Expect(string(bodies[0])).To(MatchRegexp(`(?m)^cf\.rep\.CapacityRemainingMemory\.job_total_x,deployment=cf,job=diego-cell value=100 [0-9]+$`))
+		Expect(string(bodies[0])).ToNot(ContainSubstring("nozzle.rep.CapacityRemainingMemory.job_total"))
+	})
+
+	Describe("timestamp precisions", func() {
+		postWithPrecision := func(precision string) {
+			c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+			Expect(c.SetPrecision(precision)).To(Succeed())
+
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1234567890123456789),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+				},
+			})
+
+			Expect(c.PostMetrics()).To(Succeed())
+			Expect(bodies).To(HaveLen(1))
+		}
+
+		It("writes seconds", func() {
+			postWithPrecision("s")
+
+			Expect(requestURIs).To(Equal([]string{"/write?db=testdb&precision=s"}))
+			Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName value=5 1234567890\n"))
+		})
+
+		It("writes milliseconds", func() {
+			postWithPrecision("ms")
+
+			Expect(requestURIs).To(Equal([]string{"/write?db=testdb&precision=ms"}))
+			Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName value=5 1234567890123\n"))
+		})
+
+		It("writes microseconds", func() {
+			postWithPrecision("us")
+
+			Expect(requestURIs).To(Equal([]string{"/write?db=testdb&precision=u"}))
+			Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName value=5 1234567890123456\n"))
+		})
+
+		It("writes nanoseconds", func() {
+			postWithPrecision("ns")
+
+			Expect(requestURIs).To(Equal([]string{"/write?db=testdb"}))
+			Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName value=5 1234567890123456789\n"))
+		})
+	})
+
+	Describe("automatic precision", func() {
+		postWithTimestamp := func(timestamp int64) {
+			c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+			Expect(c.SetPrecision(influxdbclient.PrecisionAuto)).To(Succeed())
+
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(timestamp),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+				},
+			})
+
+			Expect(c.PostMetrics()).To(Succeed())
+			Expect(bodies).To(HaveLen(1))
+		}
+
+		It("writes seconds when every timestamp is second-aligned", func() {
+			postWithTimestamp(2000000000)
+
+			Expect(requestURIs).To(Equal([]string{"/write?db=testdb&precision=s"}))
+			Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName value=5 2\n"))
+		})
+
+		It("writes nanoseconds when a timestamp has sub-second digits", func() {
+			postWithTimestamp(1234567890123456789)
+
+			Expect(requestURIs).To(Equal([]string{"/write?db=testdb"}))
+			Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName value=5 1234567890123456789\n"))
+		})
+	})
+
+	Context("with internal metrics in a separate batch", func() {
+		var (
+			splitServer      *httptest.Server
+			internalAttempts int
+		)
+
+		BeforeEach(func() {
+			internalAttempts = 0
+			splitServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				if bytes.Contains(body, []byte("influxdb.nozzle.origin.")) {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				internalAttempts++
+				if internalAttempts == 1 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				bodies = append(bodies, body)
+			}))
+		})
+
+		AfterEach(func() {
+			splitServer.Close()
+		})
+
+		It("retries the internal metrics even when the firehose metrics are dropped", func() {
+			c := influxdbclient.New(splitServer.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+			c.SetSeparateInternalBatch(true)
+			c.SetRetries(1, nil)
+			c.SetDropAfterFailedPosts(1)
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+				},
+			})
+
+			Expect(c.PostMetrics()).To(HaveOccurred())
+			Expect(internalAttempts).To(Equal(2))
+			Expect(bodies).To(HaveLen(1))
+			Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.totalMessagesReceived,ip=dummy-ip,deployment=test-deployment value=1 "))
+			Expect(c.BufferedPoints()).To(BeZero())
+		})
+	})
+
+	It("keeps the sub-second resolution of firehose timestamps", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+
+		for _, timestamp := range []int64{1000000000, 1200000000} {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(timestamp),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+				},
+			})
+		}
+
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(bodies).To(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName value=5 1000000000\ninfluxdb.nozzle.origin.metricName value=5 1200000000\n"))
+	})
+
+	It("writes cpu, memory and disk series for container metrics", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetContainerMetrics(true)
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("rep"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ContainerMetric.Enum(),
+			ContainerMetric: &events.ContainerMetric{
+				ApplicationId: proto.String("app-guid"),
+				InstanceIndex: proto.Int32(2),
+				CpuPercentage: proto.Float64(12.5),
+				MemoryBytes:   proto.Uint64(1024),
+				DiskBytes:     proto.Uint64(2048),
+			},
+		})
+
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(bodies).To(HaveLen(1))
+		Expect(strings.Count(string(bodies[0]), "influxdb.nozzle.rep.")).To(Equal(3))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.rep.cpu_percentage,application_id=app-guid,instance_index=2 value=12.5 1000000000\n"))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.rep.memory_bytes,application_id=app-guid,instance_index=2 value=1024 1000000000\n"))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.rep.disk_bytes,application_id=app-guid,instance_index=2 value=2048 1000000000\n"))
+	})
+
+	It("writes container metrics as fields of one measurement with the fields shape", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetContainerMetrics(true)
+		c.SetContainerShape(influxdbclient.ContainerShapeFields)
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("rep"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ContainerMetric.Enum(),
+			ContainerMetric: &events.ContainerMetric{
+				ApplicationId: proto.String("app-guid"),
+				InstanceIndex: proto.Int32(2),
+				CpuPercentage: proto.Float64(12.5),
+				MemoryBytes:   proto.Uint64(1024),
+				DiskBytes:     proto.Uint64(2048),
+			},
+		})
+
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(bodies).To(HaveLen(1))
+		Expect(strings.Count(string(bodies[0]), "influxdb.nozzle.rep.")).To(Equal(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.rep.container,application_id=app-guid,instance_index=2 value=12.5,memory_bytes=1024i,disk_bytes=2048i 1000000000\n"))
+	})
+
+	It("writes the latency of HttpStartStop envelopes in milliseconds", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetHttpMetrics(true)
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("gorouter"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_HttpStartStop.Enum(),
+			HttpStartStop: &events.HttpStartStop{
+				StartTimestamp: proto.Int64(1000000000),
+				StopTimestamp:  proto.Int64(1012500000),
+				PeerType:       events.PeerType_Client.Enum(),
+				Method:         events.Method_GET.Enum(),
+				StatusCode:     proto.Int32(200),
+				ApplicationId: &events.UUID{
+					Low:  proto.Uint64(0x0706050403020100),
+					High: proto.Uint64(0x0f0e0d0c0b0a0908),
+				},
+			},
+		})
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("gorouter"),
+			Timestamp: proto.Int64(2000000000),
+			EventType: events.Envelope_HttpStartStop.Enum(),
+			HttpStartStop: &events.HttpStartStop{
+				StartTimestamp: proto.Int64(2000000000),
+				StopTimestamp:  proto.Int64(2003000000),
+				PeerType:       events.PeerType_Client.Enum(),
+				Method:         events.Method_POST.Enum(),
+				StatusCode:     proto.Int32(404),
+			},
+		})
+
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(bodies).To(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.gorouter.http_latency_ms,application_id=00010203-0405-0607-0809-0a0b0c0d0e0f,method=GET,status_code=200 value=12.5 1000000000\n"))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.gorouter.http_latency_ms,method=POST,status_code=404 value=3 2000000000\n"))
+	})
+
+	It("drops container metrics unless they are enabled", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("rep"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ContainerMetric.Enum(),
+			ContainerMetric: &events.ContainerMetric{
+				ApplicationId: proto.String("app-guid"),
+				InstanceIndex: proto.Int32(2),
+				CpuPercentage: proto.Float64(12.5),
+				MemoryBytes:   proto.Uint64(1024),
+				DiskBytes:     proto.Uint64(2048),
+			},
+		})
+
+		Expect(c.BufferedPoints()).To(Equal(0))
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(bodies).To(HaveLen(1))
+		Expect(string(bodies[0])).NotTo(ContainSubstring("influxdb.nozzle.rep."))
+	})
+
+	It("drops HttpStartStop envelopes unless HTTP metrics are enabled", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("gorouter"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_HttpStartStop.Enum(),
+			HttpStartStop: &events.HttpStartStop{
+				StartTimestamp: proto.Int64(1000000000),
+				StopTimestamp:  proto.Int64(1012500000),
+				PeerType:       events.PeerType_Client.Enum(),
+				Method:         events.Method_GET.Enum(),
+				StatusCode:     proto.Int32(200),
+			},
+		})
+
+		Expect(c.BufferedPoints()).To(Equal(0))
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(bodies).To(HaveLen(1))
+		Expect(string(bodies[0])).NotTo(ContainSubstring("http_latency_ms"))
+	})
+
+	It("drops metrics matching the deny list and counts them", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetEmitRuntimeMetrics(true)
+		c.SetMetricFilter(nil, []string{"gorouter.latency.*", "uaa"})
+
+		for _, metric := range []struct{ origin, name string }{
+			{"gorouter", "latency.uaa"},
+			{"gorouter", "total_requests"},
+			{"uaa", "requests"},
+		} {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String(metric.origin),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String(metric.name),
+					Value: proto.Float64(5),
+				},
+			})
+		}
+
+		var names []string
+		for _, metric := range c.BufferedMetrics() {
+			names = append(names, metric.Name)
+		}
+		Expect(names).To(Equal([]string{"influxdb.nozzle.gorouter.total_requests"}))
+
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(bodies).To(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.droppedMetrics,ip=dummy-ip,deployment=test-deployment value=2 "))
+	})
+
+	It("keeps only the metrics matching the allow list", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetMetricFilter([]string{"rep.Capacity*"}, nil)
+
+		for _, name := range []string{"CapacityTotalMemory", "ContainerCount"} {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("rep"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String(name),
+					Value: proto.Float64(5),
+				},
+			})
+		}
+
+		var names []string
+		for _, metric := range c.BufferedMetrics() {
+			names = append(names, metric.Name)
+		}
+		Expect(names).To(Equal([]string{"influxdb.nozzle.rep.CapacityTotalMemory"}))
+	})
+
+	It("keeps roughly the configured fraction of envelopes per origin", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetOriginSampleRates(map[string]float64{"gorouter": 0.1, "rep": 1}, rand.New(rand.NewSource(42)))
+
+		for i := 0; i < 1000; i++ {
+			for _, origin := range []string{"gorouter", "rep", "uaa"} {
+				c.AddMetric(&events.Envelope{
+					Origin:    proto.String(origin),
+					Timestamp: proto.Int64(int64(i)),
+					EventType: events.Envelope_ValueMetric.Enum(),
+					ValueMetric: &events.ValueMetric{
+						Name:  proto.String("metricName"),
+						Value: proto.Float64(float64(i)),
+					},
+				})
+			}
+		}
+
+		points := map[string]int{}
+		for _, metric := range c.BufferedMetrics() {
+			points[metric.Name] = metric.Points
+		}
+		Expect(points["influxdb.nozzle.gorouter.metricName"]).To(BeNumerically("~", 100, 30))
+		Expect(points["influxdb.nozzle.rep.metricName"]).To(Equal(1000))
+		Expect(points["influxdb.nozzle.uaa.metricName"]).To(Equal(1000))
+	})
+
+	It("adds static tags to firehose and internal metrics", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetStaticTags(map[string]string{"env": "prod", "region": "us-east"})
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+			Tags: map[string]string{"app": "a"},
+		})
+
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(bodies).To(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName,app=a,env=prod,region=us-east value=5 1000000000\n"))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.totalMessagesReceived,ip=dummy-ip,deployment=test-deployment,env=prod,region=us-east value=1 "))
+	})
+
+	It("writes tags in the configured order ahead of the sorted rest", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+		c.SetTagOrder([]string{"zone", "env"})
+
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+			Tags: map[string]string{"app": "a", "env": "prod", "zone": "z1", "color": "blue"},
+		})
+
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(bodies).To(HaveLen(1))
+		Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName,zone=z1,env=prod,app=a,color=blue value=5 1000000000\n"))
+	})
+
+	It("hashes the same tag set to the same hex string in any order", func() {
+		job, index, ip := influxdbclient.NewTag("job", "router"), influxdbclient.NewTag("index", "0"), influxdbclient.NewTag("ip", "10.0.0.1")
+		hash := influxdbclient.HashTags([]influxdbclient.Tag{job, index, ip})
+
+		Expect(influxdbclient.HashTags([]influxdbclient.Tag{ip, job, index})).To(Equal(hash))
+		Expect(influxdbclient.HashTags([]influxdbclient.Tag{job, influxdbclient.NewTag("index", "1"), ip})).ToNot(Equal(hash))
+		Expect(hash).To(MatchRegexp("^[0-9a-f]{40}$"))
+	})
+
+	It("hashes tags apart by where the key ends", func() {
+		Expect(influxdbclient.HashTags([]influxdbclient.Tag{influxdbclient.NewTag("a=b", "c")})).
+			ToNot(Equal(influxdbclient.HashTags([]influxdbclient.Tag{influxdbclient.NewTag("a", "b=c")})))
+	})
+
+	It("leaves the order of the hashed tags untouched", func() {
+		tags := []influxdbclient.Tag{influxdbclient.NewTag("job", "router"), influxdbclient.NewTag("index", "0"), influxdbclient.NewTag("ip", "10.0.0.1")}
+
+		influxdbclient.HashTags(tags)
+
+		Expect(tags).To(Equal([]influxdbclient.Tag{influxdbclient.NewTag("job", "router"), influxdbclient.NewTag("index", "0"), influxdbclient.NewTag("ip", "10.0.0.1")}))
+	})
+
+	Describe("counter modes", func() {
+		counterValue := func(mode string) string {
+			c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+			c.SetCounterMode(mode)
+
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_CounterEvent.Enum(),
+				CounterEvent: &events.CounterEvent{
+					Name:  proto.String("counterName"),
+					Delta: proto.Uint64(3),
+					Total: proto.Uint64(42),
+				},
+			})
+			Expect(c.PostMetrics()).To(Succeed())
+
+			Expect(bodies).To(HaveLen(1))
+			match := regexp.MustCompile(`influxdb\.nozzle\.origin\.counterName value=([0-9]+) `).FindSubmatch(bodies[0])
+			Expect(match).ToNot(BeNil())
+			return string(match[1])
+		}
+
+		It("writes the running total by default", func() {
+			Expect(counterValue("")).To(Equal("42"))
+		})
+
+		It("writes the total in total mode", func() {
+			Expect(counterValue(influxdbclient.CounterModeTotal)).To(Equal("42"))
+		})
+
+		It("writes the increment in delta mode", func() {
+			Expect(counterValue(influxdbclient.CounterModeDelta)).To(Equal("3"))
+		})
+	})
+
+	Describe("field types", func() {
+		fieldTypes := []struct {
+			fieldType string
+			value     string
+		}{
+			{influxdbclient.FieldTypeFloat, "2.5"},
+			{influxdbclient.FieldTypeInt, "3i"},
+			{influxdbclient.FieldTypeBool, "true"},
+			{influxdbclient.FieldTypeString, `"2.5"`},
+		}
+
+		for _, fieldType := range fieldTypes {
+			fieldType := fieldType
+			It("writes values declared as "+fieldType.fieldType, func() {
+				c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+				c.SetFieldTypes(map[string]string{"origin.metricName": fieldType.fieldType})
+
+				for _, name := range []string{"metricName", "otherMetricName"} {
+					c.AddMetric(&events.Envelope{
+						Origin:    proto.String("origin"),
+						Timestamp: proto.Int64(1000000000),
+						EventType: events.Envelope_ValueMetric.Enum(),
+						ValueMetric: &events.ValueMetric{
+							Name:  proto.String(name),
+							Value: proto.Float64(2.5),
+						},
+					})
+				}
+				Expect(c.PostMetrics()).To(Succeed())
+
+				Expect(bodies).To(HaveLen(1))
+				Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.metricName value=" + fieldType.value + " 1000000000\n"))
+				Expect(string(bodies[0])).To(ContainSubstring("influxdb.nozzle.origin.otherMetricName value=2.5 1000000000\n"))
+			})
+		}
+	})
+
+	Describe("measurement casing", func() {
+		casings := []struct {
+			policy      string
+			measurement string
+		}{
+			{influxdbclient.MeasurementCasePreserve, "influxdb.nozzle.gorouter.HTTPRequestCount"},
+			{influxdbclient.MeasurementCaseLower, "influxdb.nozzle.gorouter.httprequestcount"},
+			{influxdbclient.MeasurementCaseUpper, "influxdb.nozzle.GOROUTER.HTTPREQUESTCOUNT"},
+			{influxdbclient.MeasurementCaseSnake, "influxdb.nozzle.gorouter.http_request_count"},
+		}
+
+		for _, casing := range casings {
+			casing := casing
+			It("writes "+casing.policy+" measurement names", func() {
+				c := influxdbclient.New(ts.URL, "testdb", "user", "password", false, "influxdb.nozzle.", "test-deployment", "dummy-ip", log)
+				c.SetMeasurementCase(casing.policy)
+
+				c.AddMetric(&events.Envelope{
+					Origin:    proto.String("gorouter"),
+					Timestamp: proto.Int64(1000000000),
+					EventType: events.Envelope_ValueMetric.Enum(),
+					ValueMetric: &events.ValueMetric{
+						Name:  proto.String("HTTPRequestCount"),
+						Value: proto.Float64(5),
+					},
+				})
+
+				Expect(c.PostMetrics()).To(Succeed())
+
+				Expect(bodies).To(HaveLen(1))
+				Expect(string(bodies[0])).To(ContainSubstring(casing.measurement + " value=5 1000000000\n"))
+			})
+		}
+	})
+})
+
+func handlePost(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		panic("No body!")
+	}
+
+	bodies = append(bodies, body)
+	requestURIs = append(requestURIs, r.URL.RequestURI())
+	userAgents = append(userAgents, r.UserAgent())
+	authHeaders = append(authHeaders, r.Header.Get("Authorization"))
+	contentTypes = append(contentTypes, r.Header.Get("Content-Type"))
+	w.WriteHeader(responseCode)
+	w.Write(responseBody)
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
 }
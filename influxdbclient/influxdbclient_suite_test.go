@@ -7,7 +7,7 @@ import (
 	"testing"
 )
 
-func TestDatadogclient(t *testing.T) {
+func TestInfluxdbclient(t *testing.T) {
 	RegisterFailHandler(Fail)
-	RunSpecs(t, "DatadogClient Suite")
+	RunSpecs(t, "InfluxDbClient Suite")
 }
@@ -0,0 +1,73 @@
+package influxdbclient
+
+import (
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// jobAggregateKey identifies the job-level series a metric is summed into.
+type jobAggregateKey struct {
+	eventType  events.Envelope_EventType
+	deployment string
+	job        string
+	name       string
+}
+
+// SetJobAggregates makes the client sum the named metrics, as written without
+// the prefix, across the instances of each job. Every post writes the sum of the
+// last value of every instance seen since the previous post as a
+// <name>.job_total series tagged with the deployment and job.
+func (c *Client) SetJobAggregates(names []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.jobAggregates = make(map[string]bool, len(names))
+	for _, name := range names {
+		c.jobAggregates[name] = true
+	}
+	c.jobTotals = make(map[jobAggregateKey]map[string]float64)
+}
+
+// aggregateJob records value as the latest of the envelope's instance when the
+// metric is summed per job.
+func (c *Client) aggregateJob(envelope *events.Envelope, name string, value float64) {
+	if !c.jobAggregates[name] {
+		return
+	}
+	key := jobAggregateKey{
+		eventType:  envelope.GetEventType(),
+		deployment: envelope.GetDeployment(),
+		job:        envelope.GetJob(),
+		name:       name,
+	}
+	instances := c.jobTotals[key]
+	if instances == nil {
+		instances = make(map[string]float64)
+		c.jobTotals[key] = instances
+	}
+	instances[envelope.GetIndex()+"/"+envelope.GetIp()] = value
+}
+
+// addJobTotals buffers the job-level sums of the interval ending now and starts
+// a new interval. The sums keep the event type of the summed metric, so they are
+// written and buffered like any other firehose series.
+func (c *Client) addJobTotals() {
+	if len(c.jobTotals) == 0 {
+		return
+	}
+	timestamp := c.now().UnixNano()
+	for aggregate, instances := range c.jobTotals {
+		var total float64
+		for _, value := range instances {
+			total += value
+		}
+		tags := []tag{{key: "deployment", value: aggregate.deployment}, {key: "job", value: aggregate.job}}
+		c.sortTags(tags)
+		key := metricKey{
+			eventType: aggregate.eventType,
+			name:      aggregate.name + ".job_total",
+			tagsHash:  hashTags(tags),
+		}
+		c.addPoint(key, tags, Point{Timestamp: timestamp, Value: total})
+	}
+	c.jobTotals = make(map[jobAggregateKey]map[string]float64)
+}
@@ -0,0 +1,83 @@
+package influxdbclient
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Formats batches can be written in. WriteFormatJSON is the legacy JSON write
+// format of InfluxDB 0.9, for old servers and proxies expecting JSON.
+const (
+	WriteFormatLine = "line"
+	WriteFormatJSON = "json"
+)
+
+type jsonPayload struct {
+	Database        string      `json:"database"`
+	RetentionPolicy string      `json:"retentionPolicy,omitempty"`
+	Precision       string      `json:"precision,omitempty"`
+	Points          []jsonPoint `json:"points"`
+}
+
+type jsonPoint struct {
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags,omitempty"`
+	Time        int64                  `json:"time"`
+	Fields      map[string]interface{} `json:"fields"`
+}
+
+func (b *batch) writeJSONSeries(measurement string, mVal metricValue) {
+	tags := make(map[string]string, len(mVal.tags))
+	for _, t := range mVal.tags {
+		tags[t.key] = t.value
+	}
+
+	for _, point := range mVal.points {
+		fields := map[string]interface{}{"value": jsonValue(point.Value, mVal.fieldType)}
+		for _, field := range point.Fields {
+			addJSONField(fields, field)
+		}
+		if b.constantField != "" {
+			addJSONField(fields, b.constantField)
+		}
+
+		timestamp, _ := strconv.ParseInt(formatTimestamp(point, b.precision), 10, 64)
+		b.points++
+		b.json.Points = append(b.json.Points, jsonPoint{
+			Measurement: measurement,
+			Tags:        tags,
+			Time:        timestamp,
+			Fields:      fields,
+		})
+	}
+}
+
+// jsonValue converts value to the JSON value of fieldType.
+func jsonValue(value float64, fieldType string) interface{} {
+	switch fieldType {
+	case FieldTypeInt:
+		return int64(math.Round(value))
+	case FieldTypeBool:
+		return value != 0
+	case FieldTypeString:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return value
+}
+
+// addJSONField converts a field formatted for the line protocol to its JSON value.
+func addJSONField(fields map[string]interface{}, field string) {
+	parts := strings.SplitN(field, "=", 2)
+	key, value := parts[0], parts[1]
+	switch {
+	case strings.HasPrefix(value, `"`):
+		value = strings.TrimSuffix(strings.TrimPrefix(value, `"`), `"`)
+		value = strings.Replace(value, `\"`, `"`, -1)
+		fields[key] = strings.Replace(value, `\\`, `\`, -1)
+	case strings.HasSuffix(value, "i"):
+		fields[key], _ = strconv.ParseInt(strings.TrimSuffix(value, "i"), 10, 64)
+	default:
+		fields[key], _ = strconv.ParseFloat(value, 64)
+	}
+}
@@ -0,0 +1,45 @@
+package influxdbclient
+
+import "time"
+
+// rateWindow counts events in a ring buffer of one-second buckets so the average
+// rate over the last len(buckets) seconds can be computed cheaply.
+type rateWindow struct {
+	counts  []uint64
+	seconds []int64
+}
+
+func newRateWindow(size time.Duration) *rateWindow {
+	buckets := int(size / time.Second)
+	if buckets < 1 {
+		buckets = 1
+	}
+	return &rateWindow{
+		counts:  make([]uint64, buckets),
+		seconds: make([]int64, buckets),
+	}
+}
+
+func (w *rateWindow) add(now time.Time) {
+	second := now.Unix()
+	index := int(second % int64(len(w.counts)))
+	if w.seconds[index] != second {
+		w.seconds[index] = second
+		w.counts[index] = 0
+	}
+	w.counts[index]++
+}
+
+// rate returns the average number of events per second over the window ending now.
+func (w *rateWindow) rate(now time.Time) float64 {
+	second := now.Unix()
+	oldest := second - int64(len(w.counts))
+
+	var total uint64
+	for index, bucketSecond := range w.seconds {
+		if bucketSecond > oldest && bucketSecond <= second {
+			total += w.counts[index]
+		}
+	}
+	return float64(total) / float64(len(w.counts))
+}
@@ -0,0 +1,49 @@
+package influxdbclient
+
+import (
+	"sync"
+	"time"
+)
+
+// RetryBudget is a token bucket limiting how many failed writes are retried, so
+// retries don't amplify the load on InfluxDB during wide outages. A single budget
+// is meant to be shared by every client in the process.
+type RetryBudget struct {
+	capacity float64
+	refill   float64
+	tokens   float64
+	last     time.Time
+	now      func() time.Time
+	lock     sync.Mutex
+}
+
+// NewRetryBudget returns a full budget of capacity retries, replenished at
+// refillPerSecond retries per second.
+func NewRetryBudget(capacity int, refillPerSecond float64, now func() time.Time) *RetryBudget {
+	return &RetryBudget{
+		capacity: float64(capacity),
+		refill:   refillPerSecond,
+		tokens:   float64(capacity),
+		last:     now(),
+		now:      now,
+	}
+}
+
+// Take consumes a retry from the budget, returning false if none is left.
+func (r *RetryBudget) Take() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.now()
+	r.tokens += now.Sub(r.last).Seconds() * r.refill
+	if r.tokens > r.capacity {
+		r.tokens = r.capacity
+	}
+	r.last = now
+
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
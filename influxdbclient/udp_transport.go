@@ -0,0 +1,61 @@
+package influxdbclient
+
+import (
+	"bytes"
+	"net"
+)
+
+// DefaultUDPPayloadSize is the largest datagram written to the UDP listener
+// unless configured otherwise. It fits in a single packet on any network.
+const DefaultUDPPayloadSize = 512
+
+// SetUDP makes the client write to the InfluxDB UDP listener at address, a
+// host:port, instead of posting over HTTP. Writes are fire-and-forget line
+// protocol packed into datagrams of at most payloadSize bytes; a line longer than
+// that is dropped. The listener's precision has to match the client's, as UDP
+// writes carry no precision parameter.
+func (c *Client) SetUDP(address string, payloadSize int) error {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+	if payloadSize <= 0 {
+		payloadSize = DefaultUDPPayloadSize
+	}
+	c.udpConn = conn
+	c.udpPayloadSize = payloadSize
+	return nil
+}
+
+// writeUDP sends the lines of a batch in as few datagrams as fit them.
+func (c *Client) writeUDP(b *batch) error {
+	datagram := getBuffer()
+	defer bufferPool.Put(datagram)
+	datagram.Reset()
+
+	for _, line := range bytes.SplitAfter(b.buffer.Bytes(), []byte(b.lineTerminator)) {
+		if len(line) == 0 {
+			continue
+		}
+		if len(line) > c.udpPayloadSize {
+			b.dropped++
+			continue
+		}
+		if datagram.Len()+len(line) > c.udpPayloadSize {
+			if _, err := c.udpConn.Write(datagram.Bytes()); err != nil {
+				return err
+			}
+			datagram.Reset()
+		}
+		datagram.Write(line)
+	}
+	if datagram.Len() == 0 {
+		return nil
+	}
+	_, err := c.udpConn.Write(datagram.Bytes())
+	return err
+}
@@ -0,0 +1,20 @@
+package influxdbclient
+
+import "fmt"
+
+// WriteError is returned when InfluxDB answers a write with a non 2xx response.
+type WriteError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("InfluxDB request returned HTTP response: %s;\n%s", e.Status, e.Body)
+}
+
+// Retryable reports whether the write may succeed when repeated, which is the
+// case for server errors but not for rejected requests.
+func (e *WriteError) Retryable() bool {
+	return e.StatusCode >= 500
+}
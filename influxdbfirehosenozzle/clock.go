@@ -0,0 +1,34 @@
+package influxdbfirehosenozzle
+
+import "time"
+
+// Clock provides the time source and tickers driving the flush loop.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+// realTicker wraps time.Ticker, whose ticks carry monotonic clock readings so
+// intervals measured against them are unaffected by system clock changes.
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
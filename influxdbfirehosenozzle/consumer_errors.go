@@ -0,0 +1,47 @@
+package influxdbfirehosenozzle
+
+import (
+	"net"
+	"strings"
+
+	noaa_errors "github.com/cloudfoundry/noaa/errors"
+	"github.com/gorilla/websocket"
+)
+
+// Categories of the errors returned by the firehose consumer.
+const (
+	ConsumerErrorSlowConsumer = "slowConsumer"
+	ConsumerErrorAuth         = "auth"
+	ConsumerErrorNetwork      = "network"
+	ConsumerErrorClosed       = "closed"
+	ConsumerErrorOther        = "other"
+)
+
+// ConsumerErrorCategory classifies an error read from the firehose.
+func ConsumerErrorCategory(err error) string {
+	switch typedErr := err.(type) {
+	case *websocket.CloseError:
+		switch typedErr.Code {
+		case websocket.CloseNormalClosure:
+			return ConsumerErrorClosed
+		case websocket.ClosePolicyViolation:
+			return ConsumerErrorSlowConsumer
+		default:
+			return ConsumerErrorNetwork
+		}
+	case *noaa_errors.UnauthorizedError:
+		return ConsumerErrorAuth
+	case net.Error:
+		return ConsumerErrorNetwork
+	}
+
+	// The consumer reports failed dials as plain errors wrapping the cause's message.
+	switch message := err.Error(); {
+	case strings.Contains(message, "Unauthorized error"):
+		return ConsumerErrorAuth
+	case strings.Contains(message, "Error dialing traffic controller server"):
+		return ConsumerErrorNetwork
+	default:
+		return ConsumerErrorOther
+	}
+}
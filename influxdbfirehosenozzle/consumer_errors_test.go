@@ -0,0 +1,30 @@
+package influxdbfirehosenozzle_test
+
+import (
+	"errors"
+
+	"github.com/andrew-edgar/influxdb-firehose-nozzle/influxdbfirehosenozzle"
+	noaa_errors "github.com/cloudfoundry/noaa/errors"
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ConsumerErrorCategory", func() {
+	It("categorizes firehose consumer errors", func() {
+		categories := map[error]string{
+			&websocket.CloseError{Code: websocket.ClosePolicyViolation}:                           influxdbfirehosenozzle.ConsumerErrorSlowConsumer,
+			&websocket.CloseError{Code: websocket.CloseNormalClosure}:                             influxdbfirehosenozzle.ConsumerErrorClosed,
+			&websocket.CloseError{Code: websocket.CloseAbnormalClosure}:                           influxdbfirehosenozzle.ConsumerErrorNetwork,
+			noaa_errors.NewUnauthorizedError("bad token"):                                         influxdbfirehosenozzle.ConsumerErrorAuth,
+			errors.New("Error dialing traffic controller server: Unauthorized error: bad token."): influxdbfirehosenozzle.ConsumerErrorAuth,
+			errors.New("Error dialing traffic controller server: dial tcp: connection refused."):  influxdbfirehosenozzle.ConsumerErrorNetwork,
+			errors.New("something else"):                                                          influxdbfirehosenozzle.ConsumerErrorOther,
+		}
+
+		for err, category := range categories {
+			Expect(influxdbfirehosenozzle.ConsumerErrorCategory(err)).To(Equal(category), err.Error())
+		}
+	})
+})
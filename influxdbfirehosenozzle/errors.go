@@ -0,0 +1,28 @@
+package influxdbfirehosenozzle
+
+// Reasons the shutdown metric is tagged with besides the firehose error
+// categories. ShutdownReasonSignal is used when the nozzle is stopped with Stop,
+// ShutdownReasonFatalError when metrics could not be posted.
+const (
+	ShutdownReasonSignal     = "signal"
+	ShutdownReasonFatalError = "fatalError"
+)
+
+// AuthError is returned by Start when no token could be fetched for the firehose.
+type AuthError struct {
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return "Error fetching the firehose auth token: " + e.Err.Error()
+}
+
+// InfluxDbError is returned by Start when metrics could not be posted to InfluxDB
+// and the nozzle is not configured to drop them.
+type InfluxDbError struct {
+	Err error
+}
+
+func (e *InfluxDbError) Error() string {
+	return "Error posting metrics to InfluxDB: " + e.Err.Error()
+}
@@ -1,8 +1,13 @@
 package influxdbfirehosenozzle
 
 import (
+	"compress/gzip"
 	"crypto/tls"
 	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/andrew-edgar/influxdb-firehose-nozzle/influxdbclient"
@@ -21,6 +26,13 @@ type InfluxDbFirehoseNozzle struct {
 	authTokenFetcher AuthTokenFetcher
 	consumer         *consumer.Consumer
 	client           *influxdbclient.Client
+	clientLock       sync.Mutex
+	workerPool       *WorkerPool
+	flushRequests    chan struct{}
+	stopRequests     chan struct{}
+	stopOnce         sync.Once
+	done             chan struct{}
+	clock            Clock
 	log              *gosteno.Logger
 }
 
@@ -28,26 +40,85 @@ type AuthTokenFetcher interface {
 	FetchAuthToken() string
 }
 
+// FallibleTokenFetcher is implemented by token fetchers which can report failing
+// to fetch a token instead of exiting.
+type FallibleTokenFetcher interface {
+	TryFetchAuthToken() (string, error)
+}
+
+// TokenExpiryReporter is implemented by token fetchers which know when the last
+// fetched token expires.
+type TokenExpiryReporter interface {
+	TokenExpiry() time.Time
+}
+
 func NewInfluxDbFirehoseNozzle(config *nozzleconfig.NozzleConfig, tokenFetcher AuthTokenFetcher, log *gosteno.Logger) *InfluxDbFirehoseNozzle {
 	return &InfluxDbFirehoseNozzle{
 		config:           config,
 		authTokenFetcher: tokenFetcher,
+		clock:            realClock{},
+		flushRequests:    make(chan struct{}, 1),
+		stopRequests:     make(chan struct{}),
+		done:             make(chan struct{}),
 		log:              log,
 	}
 }
 
+// FlushOnSignal posts the buffered metrics immediately whenever a signal arrives,
+// until the channel is closed.
+func (d *InfluxDbFirehoseNozzle) FlushOnSignal(signals <-chan os.Signal) {
+	for sig := range signals {
+		d.log.Infof("Received %s, flushing metrics", sig)
+		select {
+		case d.flushRequests <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Stop makes Start close the firehose connection, post the buffered metrics one
+// final time and return. It must be called after Start, and returns once Start
+// has returned.
+func (d *InfluxDbFirehoseNozzle) Stop() {
+	d.stopOnce.Do(func() {
+		close(d.stopRequests)
+	})
+	<-d.done
+}
+
+// SetClock replaces the clock driving the flush loop. It must be called before Start.
+func (d *InfluxDbFirehoseNozzle) SetClock(clock Clock) {
+	d.clock = clock
+}
+
 func (d *InfluxDbFirehoseNozzle) Start() error {
+	defer close(d.done)
 	var authToken string
 
 	if !d.config.DisableAccessControl {
-		authToken = d.authTokenFetcher.FetchAuthToken()
+		if fetcher, ok := d.authTokenFetcher.(FallibleTokenFetcher); ok {
+			var err error
+			authToken, err = fetcher.TryFetchAuthToken()
+			if err != nil {
+				return &AuthError{Err: err}
+			}
+		} else {
+			authToken = d.authTokenFetcher.FetchAuthToken()
+		}
 	}
 
 	d.log.Info("Starting InfluxDb Firehose Nozzle...")
 	d.createClient()
+	if reporter, ok := d.authTokenFetcher.(TokenExpiryReporter); ok && authToken != "" {
+		d.client.SetTokenExpiry(reporter.TokenExpiry())
+	}
 	d.consumeFirehose(authToken)
 	err := d.postToInfluxDb()
-	d.log.Infof("InfluxDb Firehose Nozzle shutting down... %s", err.Error())
+	if err != nil {
+		d.log.Infof("InfluxDb Firehose Nozzle shutting down... %s", err.Error())
+	} else {
+		d.log.Info("InfluxDb Firehose Nozzle shutting down...")
+	}
 	log.Print()
 	return err
 }
@@ -58,7 +129,7 @@ func (d *InfluxDbFirehoseNozzle) createClient() {
 		panic(err)
 	}
 
-	d.client = influxdbclient.New(
+	client := influxdbclient.New(
 		d.config.InfluxDbUrl,
 		d.config.InfluxDbDatabase,
 		d.config.InfluxDbUser,
@@ -69,6 +140,143 @@ func (d *InfluxDbFirehoseNozzle) createClient() {
 		ipAddress,
 		d.log,
 	)
+	for _, warning := range d.config.Warnings {
+		d.log.Warnf("Config warning: %s", warning)
+	}
+	client.SetConfigWarnings(len(d.config.Warnings))
+	if d.config.InfluxDbVersion == 2 {
+		client.SetAPIV2(d.config.InfluxDbOrg, d.config.InfluxDbToken)
+	}
+	client.SetTLSServerName(d.config.InfluxDbTLSServerName)
+	client.SetInternalMetricPrefix(d.config.InternalMetricPrefix)
+	client.SetSeparateInternalBatch(d.config.SeparateInternalBatch)
+	client.SetMeasurementSuffix(d.config.MeasurementSuffix)
+	client.SetMeasurementCase(d.config.MeasurementCase)
+	client.SetEnvelopeFieldMapping(d.config.EnvelopeFieldMapping)
+	client.SetTagNames(d.config.TagNames)
+	client.SetTagOrder(d.config.TagOrder)
+	client.SetStaticTags(d.config.StaticTags)
+	client.SetPromoteCFTags(d.config.PromoteCFTags)
+	client.SetSourceIDTag(d.config.EmitSourceIDTag)
+	client.SetDuplicateTagPolicy(d.config.DuplicateTagPolicy)
+	client.SetIndexFormat(d.config.IndexFormat)
+	client.SetMaxTagsPerSeries(int(d.config.MaxTagsPerSeries))
+	client.SetEmptyNamePolicy(d.config.EmptyNamePolicy)
+	client.SetRedactedTags(d.config.RedactedTags, d.config.TagRedactionMode)
+	client.SetContainerMetrics(d.config.EmitContainerMetrics)
+	client.SetContainerShape(d.config.ContainerShape)
+	client.SetHttpMetrics(d.config.EmitHttpMetrics)
+	client.SetCounterMode(d.config.CounterMode)
+	client.SetFieldTypes(d.config.FieldTypes)
+	client.SetCounterShape(d.config.CounterShape)
+	client.SetCompactRepeatedValues(d.config.CompactRepeatedValues)
+	client.SetMetricFilter(d.config.MetricAllowList, d.config.MetricDenyList)
+	if d.config.BufferCapAction == influxdbclient.BufferCapDrop {
+		client.SetMaxBufferBytes(int(d.config.MaxBufferBytes))
+	}
+	client.SetOriginSampleRates(d.config.OriginSampleRates, rand.New(rand.NewSource(time.Now().UnixNano())))
+	client.SetJobAggregates(d.config.JobAggregates)
+	client.SetResetSafeCounters(d.config.ResetSafeCounters)
+	client.SetEmitRuntimeMetrics(d.config.EmitRuntimeMetrics)
+	client.SetTagSetReportInterval(time.Duration(d.config.TagSetReportSeconds) * time.Second)
+	client.SetCounterFlushInterval(time.Duration(d.config.CounterFlushDurationSeconds) * time.Second)
+	client.SetErrorBodyLogLimit(int(d.config.ErrorBodyLogLimit))
+	client.SetQuarantineConflicts(d.config.QuarantineConflictingMeasurements)
+	client.SetMaxLineLength(int(d.config.MaxLineLength))
+	client.SetMaxLinesPerRequest(int(d.config.MaxLinesPerRequest))
+	client.SetUserAgent(d.config.UserAgent)
+	client.SetWriteFormat(d.config.WriteFormat)
+	if d.config.WriteDeadlinePercent > 0 {
+		flushInterval := time.Duration(d.config.FlushDurationSeconds) * time.Second
+		client.SetWriteTimeout(flushInterval * time.Duration(d.config.WriteDeadlinePercent) / 100)
+	}
+	gzipLevel := gzip.DefaultCompression
+	if d.config.GzipLevel > 0 {
+		gzipLevel = int(d.config.GzipLevel)
+	}
+	err = client.SetGzip(d.config.GzipWrites, gzipLevel)
+	if err != nil {
+		panic(err)
+	}
+	client.SetAcceptGzip(d.config.AcceptGzipResponses)
+	if d.config.UDPAddress != "" {
+		err = client.SetUDP(d.config.UDPAddress, int(d.config.UDPPayloadSize))
+		if err != nil {
+			panic(err)
+		}
+	}
+	err = client.SetDeploymentEventTypes(d.config.DeploymentEventTypes)
+	if err != nil {
+		panic(err)
+	}
+	precision, measurementPrecisions := d.config.Precision, d.config.MeasurementPrecisions
+	if d.config.SecondTimestamps {
+		precision, measurementPrecisions = "s", nil
+	}
+	err = client.SetPrecision(precision)
+	if err != nil {
+		panic(err)
+	}
+	err = client.SetMeasurementPrecisions(measurementPrecisions)
+	if err != nil {
+		panic(err)
+	}
+	client.SetDropAfterFailedPosts(int(d.config.DropPointsAfterFailedPosts))
+	if d.config.MaxRetries > 0 {
+		var budget *influxdbclient.RetryBudget
+		if d.config.RetryBudgetPerMinute > 0 {
+			budget = influxdbclient.NewRetryBudget(int(d.config.RetryBudgetPerMinute), float64(d.config.RetryBudgetPerMinute)/60, time.Now)
+		}
+		client.SetRetries(int(d.config.MaxRetries), budget)
+		client.SetRetryBackoff(
+			time.Duration(d.config.RetryBaseDelayMilliseconds)*time.Millisecond,
+			time.Duration(d.config.RetryMaxDelayMilliseconds)*time.Millisecond,
+		)
+		client.SetDNSRetryDelay(time.Duration(d.config.DNSRetryDelayMilliseconds) * time.Millisecond)
+	}
+	if d.config.DataDogDualWrite {
+		client.SetDatadogSink(d.config.DataDogURL, d.config.DataDogAPIKey)
+	}
+	client.SetSkipIdlePosts(d.config.SkipIdlePosts)
+	client.SetLineTerminator(d.config.LineTerminator)
+	client.SetConstantField(d.config.ConstantFieldKey, d.config.ConstantFieldValue)
+	err = client.SetRetentionPolicies(d.config.RetentionPolicies)
+	if err != nil {
+		panic(err)
+	}
+	if d.config.EmitCounterRates {
+		client.SetCounterRateInterval(time.Duration(d.config.FlushDurationSeconds) * time.Second)
+	}
+	client.SetSilenceThreshold(time.Duration(d.config.FirehoseSilenceSeconds) * time.Second)
+	if d.config.ReceiveRateWindowSeconds > 0 {
+		client.SetReceiveRateWindow(time.Duration(d.config.ReceiveRateWindowSeconds) * time.Second)
+	}
+
+	d.clientLock.Lock()
+	d.client = client
+	d.clientLock.Unlock()
+
+	if d.config.MetricWorkers > 0 {
+		d.workerPool = NewWorkerPool(int(d.config.MetricWorkers), int(d.config.MetricQueueSize), d.client)
+	}
+}
+
+// Client returns the InfluxDB client, or nil until the nozzle has started.
+func (d *InfluxDbFirehoseNozzle) Client() *influxdbclient.Client {
+	d.clientLock.Lock()
+	defer d.clientLock.Unlock()
+
+	return d.client
+}
+
+// ServeDebugBuffer lists the metrics buffered for the next post as JSON.
+func (d *InfluxDbFirehoseNozzle) ServeDebugBuffer(w http.ResponseWriter, r *http.Request) {
+	client := d.Client()
+	if client == nil {
+		http.Error(w, "nozzle has not started", http.StatusServiceUnavailable)
+		return
+	}
+	client.ServeBuffer(w, r)
 }
 
 func (d *InfluxDbFirehoseNozzle) consumeFirehose(authToken string) {
@@ -81,29 +289,110 @@ func (d *InfluxDbFirehoseNozzle) consumeFirehose(authToken string) {
 }
 
 func (d *InfluxDbFirehoseNozzle) postToInfluxDb() error {
-	ticker := time.NewTicker(time.Duration(d.config.FlushDurationSeconds) * time.Second)
+	ticker := d.clock.NewTicker(time.Duration(d.config.FlushDurationSeconds) * time.Second)
+	defer ticker.Stop()
 	for {
 		select {
-		case <-ticker.C:
-			d.postMetrics()
+		case scheduled := <-ticker.C():
+			d.client.RecordFlushDrift(d.flushDrift(scheduled))
+			if err := d.postMetrics(); err != nil {
+				return d.abort(err)
+			}
+		case <-d.flushRequests:
+			if err := d.postMetrics(); err != nil {
+				return d.abort(err)
+			}
+		case <-d.stopRequests:
+			return d.stop()
 		case envelope := <-d.messages:
 			d.handleMessage(envelope)
-			d.client.AddMetric(envelope)
+			d.addMetric(envelope)
+			if d.bufferFull() {
+				if err := d.postMetrics(); err != nil {
+					return d.abort(err)
+				}
+			}
 		case err := <-d.errs:
-			d.handleError(err)
+			if postErr := d.handleError(err); postErr != nil {
+				return postErr
+			}
 			return err
 		}
 	}
 }
 
-func (d *InfluxDbFirehoseNozzle) postMetrics() {
+// bufferFull reports whether the buffer reached a threshold for flushing early.
+func (d *InfluxDbFirehoseNozzle) bufferFull() bool {
+	if d.config.FlushPointCount > 0 && d.client.BufferedPoints() >= int(d.config.FlushPointCount) {
+		return true
+	}
+	if d.config.FlushMetricCount > 0 && d.client.PendingMetrics() >= int(d.config.FlushMetricCount) {
+		return true
+	}
+	return d.config.MaxBufferBytes > 0 && d.config.BufferCapAction != influxdbclient.BufferCapDrop && d.client.BufferedBytes() >= int(d.config.MaxBufferBytes)
+}
+
+// flushDrift returns how late a flush started. The ticker keeps its own schedule,
+// so a slow flush or a system clock change never shifts later flushes; a clock
+// jumping backwards is reported as no drift.
+func (d *InfluxDbFirehoseNozzle) flushDrift(scheduled time.Time) time.Duration {
+	drift := d.clock.Now().Sub(scheduled)
+	if drift < 0 {
+		return 0
+	}
+	return drift
+}
+
+func (d *InfluxDbFirehoseNozzle) addMetric(envelope *events.Envelope) {
+	if d.workerPool != nil {
+		d.workerPool.Submit(envelope)
+		return
+	}
+	d.client.AddMetric(envelope)
+}
+
+// postMetrics posts the buffered metrics, returning an InfluxDbError when the
+// nozzle has to stop because they could not be posted.
+func (d *InfluxDbFirehoseNozzle) postMetrics() error {
 	err := d.client.PostMetrics()
 	if err != nil {
-		d.log.Fatalf("FATAL ERROR: %s\n\n", err)
+		if d.config.DropPointsAfterFailedPosts > 0 {
+			d.log.Errorf("Error posting metrics: %s", err)
+			return nil
+		}
+		d.log.Errorf("FATAL ERROR: %s\n\n", err)
+		return &InfluxDbError{Err: err}
 	}
+	return nil
 }
 
-func (d *InfluxDbFirehoseNozzle) handleError(err error) {
+// abort records that the nozzle stops because metrics could not be posted and
+// makes a last attempt to post that record, returning err.
+func (d *InfluxDbFirehoseNozzle) abort(err error) error {
+	d.stopWorkers()
+	d.client.RecordShutdown(ShutdownReasonFatalError)
+	if postErr := d.client.PostMetrics(); postErr != nil {
+		d.log.Errorf("Error posting the shutdown metric: %s", postErr)
+	}
+	return err
+}
+
+// stop closes the firehose connection and posts the remaining metrics for a
+// shutdown requested with Stop, returning the error of that post.
+func (d *InfluxDbFirehoseNozzle) stop() error {
+	d.log.Info("Closing connection with traffic controller after a stop request")
+	d.consumer.Close()
+	d.stopWorkers()
+	d.client.RecordShutdown(ShutdownReasonSignal)
+	return d.postMetrics()
+}
+
+// handleError closes the firehose connection after err and posts the remaining
+// metrics, returning the error of that post.
+func (d *InfluxDbFirehoseNozzle) handleError(err error) error {
+	d.client.RecordConsumerError(ConsumerErrorCategory(err))
+	d.client.RecordShutdown(ConsumerErrorCategory(err))
+
 	switch closeErr := err.(type) {
 	case *websocket.CloseError:
 		switch closeErr.Code {
@@ -123,7 +412,16 @@ func (d *InfluxDbFirehoseNozzle) handleError(err error) {
 
 	d.log.Infof("Closing connection with traffic controller due to %v", err)
 	d.consumer.Close()
-	d.postMetrics()
+	d.stopWorkers()
+	return d.postMetrics()
+}
+
+// stopWorkers waits for the worker pool, if any, to add the envelopes it queued.
+// Every path out of postToInfluxDb calls it so no worker outlives the nozzle.
+func (d *InfluxDbFirehoseNozzle) stopWorkers() {
+	if d.workerPool != nil {
+		d.workerPool.Stop()
+	}
 }
 
 func (d *InfluxDbFirehoseNozzle) handleMessage(envelope *events.Envelope) {
@@ -1 +1,336 @@
 package influxdbfirehosenozzle_test
+
+import (
+	"errors"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/andrew-edgar/influxdb-firehose-nozzle/influxdbfirehosenozzle"
+	"github.com/andrew-edgar/influxdb-firehose-nozzle/nozzleconfig"
+	"github.com/andrew-edgar/influxdb-firehose-nozzle/testhelpers"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("InfluxDbFirehoseNozzle", func() {
+	var (
+		fakeFirehose *testhelpers.FakeIdleFirehose
+		fakeInfluxDb *testhelpers.FakeInfluxDbAPI
+		config       *nozzleconfig.NozzleConfig
+		nozzle       *influxdbfirehosenozzle.InfluxDbFirehoseNozzle
+		fakeClock    *testhelpers.FakeClock
+		tokenFetcher influxdbfirehosenozzle.AuthTokenFetcher
+		stopped      chan struct{}
+		startErr     error
+	)
+
+	BeforeEach(func() {
+		fakeFirehose = testhelpers.NewFakeIdleFirehose(time.Minute)
+		fakeFirehose.Start()
+		fakeInfluxDb = testhelpers.NewFakeInfluxDbAPI()
+		fakeInfluxDb.Start()
+
+		config = &nozzleconfig.NozzleConfig{
+			TrafficControllerURL: strings.Replace(fakeFirehose.URL(), "http:", "ws:", 1),
+			InfluxDbUrl:          fakeInfluxDb.URL(),
+			InfluxDbDatabase:     "testdb",
+			FlushDurationSeconds: 1,
+			MetricPrefix:         "influxdb.nozzle.",
+			Deployment:           "test-deployment",
+			DisableAccessControl: true,
+		}
+		fakeClock = nil
+		tokenFetcher = &testhelpers.FakeTokenFetcher{}
+		stopped = make(chan struct{})
+		startErr = nil
+	})
+
+	JustBeforeEach(func() {
+		nozzle = influxdbfirehosenozzle.NewInfluxDbFirehoseNozzle(config, tokenFetcher, testhelpers.Logger())
+		if fakeClock != nil {
+			nozzle.SetClock(fakeClock)
+		}
+		go func() {
+			defer close(stopped)
+			startErr = nozzle.Start()
+		}()
+	})
+
+	AfterEach(func() {
+		fakeInfluxDb.SetDelay(0)
+		fakeFirehose.Close()
+		Eventually(stopped, 5).Should(BeClosed())
+		fakeInfluxDb.Close()
+	})
+
+	Context("with runtime metrics", func() {
+		BeforeEach(func() {
+			config.EmitRuntimeMetrics = true
+		})
+
+		It("reports a positive flush drift when posts take longer than the flush interval", func() {
+			fakeInfluxDb.SetDelay(1500 * time.Millisecond)
+			driftPattern := regexp.MustCompile(`flushDriftMs,[^ ]* value=([0-9.]+) `)
+
+			Eventually(func() float64 {
+				select {
+				case contents := <-fakeInfluxDb.ReceivedContents:
+					match := driftPattern.FindSubmatch(contents)
+					if match == nil {
+						return 0
+					}
+					drift, _ := strconv.ParseFloat(string(match[1]), 64)
+					return drift
+				default:
+					return 0
+				}
+			}, 10).Should(BeNumerically(">", 100))
+		})
+	})
+
+	Context("when no auth token can be fetched", func() {
+		BeforeEach(func() {
+			config.DisableAccessControl = false
+			tokenFetcher = &failingTokenFetcher{}
+		})
+
+		It("stops with an AuthError", func() {
+			Eventually(stopped, 5).Should(BeClosed())
+			Expect(startErr).To(BeAssignableToTypeOf(&influxdbfirehosenozzle.AuthError{}))
+		})
+	})
+
+	Context("when InfluxDB can't be reached", func() {
+		BeforeEach(func() {
+			unreachable := testhelpers.NewFakeInfluxDbAPI()
+			unreachable.Start()
+			config.InfluxDbUrl = unreachable.URL()
+			unreachable.Close()
+		})
+
+		It("stops with an InfluxDbError", func() {
+			Eventually(stopped, 5).Should(BeClosed())
+			Expect(startErr).To(BeAssignableToTypeOf(&influxdbfirehosenozzle.InfluxDbError{}))
+		})
+
+		Context("with metric workers", func() {
+			BeforeEach(func() {
+				config.MetricWorkers = 2
+				config.MetricQueueSize = 10
+			})
+
+			It("stops the workers and stops with an InfluxDbError", func() {
+				Eventually(stopped, 5).Should(BeClosed())
+				Expect(startErr).To(BeAssignableToTypeOf(&influxdbfirehosenozzle.InfluxDbError{}))
+			})
+		})
+	})
+
+	Context("when the firehose closes the connection", func() {
+		BeforeEach(func() {
+			fakeFirehose.Close()
+			fakeFirehose = testhelpers.NewFakeIdleFirehose(100 * time.Millisecond)
+			fakeFirehose.Start()
+			config.TrafficControllerURL = strings.Replace(fakeFirehose.URL(), "http:", "ws:", 1)
+			fakeClock = testhelpers.NewFakeClock(time.Unix(1000, 0))
+		})
+
+		It("reports why it shut down with the final post", func() {
+			var contents []byte
+			Eventually(fakeInfluxDb.ReceivedContents, 5).Should(Receive(&contents))
+			Eventually(stopped, 5).Should(BeClosed())
+			Expect(string(contents)).To(MatchRegexp(`influxdb\.nozzle\.shutdown,[^ ]*reason=` + influxdbfirehosenozzle.ConsumerErrorCategory(startErr) + ` value=1 `))
+		})
+	})
+
+	Context("with a point threshold", func() {
+		var fakePointFirehose *testhelpers.FakeFirehose
+
+		BeforeEach(func() {
+			fakePointFirehose = testhelpers.NewFakeFirehose("")
+			for i := 0; i < 5; i++ {
+				fakePointFirehose.AddEvent(events.Envelope{
+					Origin:    proto.String("origin"),
+					Timestamp: proto.Int64(1000000000 + int64(i)),
+					EventType: events.Envelope_ValueMetric.Enum(),
+					ValueMetric: &events.ValueMetric{
+						Name:  proto.String("metricName"),
+						Value: proto.Float64(5),
+						Unit:  proto.String("gauge"),
+					},
+				})
+			}
+			fakePointFirehose.Start()
+
+			config.TrafficControllerURL = strings.Replace(fakePointFirehose.URL(), "http:", "ws:", 1)
+			config.FlushPointCount = 2
+			fakeClock = testhelpers.NewFakeClock(time.Unix(1000, 0))
+		})
+
+		AfterEach(func() {
+			fakePointFirehose.Close()
+		})
+
+		It("flushes as soon as the threshold is reached", func() {
+			pointPattern := regexp.MustCompile(`(?m)^influxdb\.nozzle\.origin\.metricName `)
+
+			var contents []byte
+			Eventually(fakeInfluxDb.ReceivedContents, 5).Should(Receive(&contents))
+			Expect(pointPattern.FindAll(contents, -1)).To(HaveLen(2))
+			Eventually(fakeInfluxDb.ReceivedContents, 5).Should(Receive(&contents))
+			Expect(pointPattern.FindAll(contents, -1)).To(HaveLen(2))
+		})
+	})
+
+	Context("with a metric threshold", func() {
+		var fakeMetricFirehose *testhelpers.FakeFirehose
+
+		BeforeEach(func() {
+			fakeMetricFirehose = testhelpers.NewFakeFirehose("")
+			for i := 0; i < 4; i++ {
+				fakeMetricFirehose.AddEvent(events.Envelope{
+					Origin:    proto.String("origin"),
+					Timestamp: proto.Int64(1000000000),
+					EventType: events.Envelope_ValueMetric.Enum(),
+					ValueMetric: &events.ValueMetric{
+						Name:  proto.String("metricName" + strconv.Itoa(i)),
+						Value: proto.Float64(5),
+						Unit:  proto.String("gauge"),
+					},
+				})
+			}
+			fakeMetricFirehose.Start()
+
+			config.TrafficControllerURL = strings.Replace(fakeMetricFirehose.URL(), "http:", "ws:", 1)
+			config.FlushMetricCount = 2
+			fakeClock = testhelpers.NewFakeClock(time.Unix(1000, 0))
+		})
+
+		AfterEach(func() {
+			fakeMetricFirehose.Close()
+		})
+
+		It("flushes as soon as the threshold is reached", func() {
+			metricPattern := regexp.MustCompile(`(?m)^influxdb\.nozzle\.origin\.metricName[0-9] `)
+
+			var contents []byte
+			Eventually(fakeInfluxDb.ReceivedContents, 5).Should(Receive(&contents))
+			Expect(metricPattern.FindAll(contents, -1)).To(HaveLen(2))
+			Eventually(fakeInfluxDb.ReceivedContents, 5).Should(Receive(&contents))
+			Expect(metricPattern.FindAll(contents, -1)).To(HaveLen(2))
+		})
+	})
+
+	Context("with a buffer byte cap", func() {
+		var fakeMetricFirehose *testhelpers.FakeFirehose
+
+		BeforeEach(func() {
+			fakeMetricFirehose = testhelpers.NewFakeFirehose("")
+			for i := 0; i < 4; i++ {
+				fakeMetricFirehose.AddEvent(events.Envelope{
+					Origin:    proto.String("origin"),
+					Timestamp: proto.Int64(1000000000),
+					EventType: events.Envelope_ValueMetric.Enum(),
+					ValueMetric: &events.ValueMetric{
+						Name:  proto.String("metricName" + strconv.Itoa(i)),
+						Value: proto.Float64(5),
+						Unit:  proto.String("gauge"),
+					},
+				})
+			}
+			fakeMetricFirehose.Start()
+
+			config.TrafficControllerURL = strings.Replace(fakeMetricFirehose.URL(), "http:", "ws:", 1)
+			config.MaxBufferBytes = 1
+			fakeClock = testhelpers.NewFakeClock(time.Unix(1000, 0))
+		})
+
+		AfterEach(func() {
+			fakeMetricFirehose.Close()
+		})
+
+		It("flushes as soon as the cap is reached", func() {
+			metricPattern := regexp.MustCompile(`(?m)^influxdb\.nozzle\.origin\.metricName[0-9] `)
+
+			for i := 0; i < 4; i++ {
+				var contents []byte
+				Eventually(fakeInfluxDb.ReceivedContents, 5).Should(Receive(&contents))
+				Expect(metricPattern.FindAll(contents, -1)).To(HaveLen(1))
+			}
+		})
+	})
+
+	Context("with a fake clock", func() {
+		var start time.Time
+
+		BeforeEach(func() {
+			start = time.Unix(1000, 0)
+			fakeClock = testhelpers.NewFakeClock(start)
+			config.EmitRuntimeMetrics = true
+		})
+
+		It("flushes when signalled", func() {
+			signals := make(chan os.Signal, 1)
+			defer close(signals)
+			go nozzle.FlushOnSignal(signals)
+
+			Consistently(fakeInfluxDb.ReceivedContents, 0.5).ShouldNot(Receive())
+			signals <- syscall.SIGUSR2
+
+			var contents []byte
+			Eventually(fakeInfluxDb.ReceivedContents, 5).Should(Receive(&contents))
+			Expect(string(contents)).To(ContainSubstring("influxdb.nozzle.totalMessagesReceived"))
+		})
+
+		It("posts the buffered metrics one final time when stopped", func() {
+			Consistently(fakeInfluxDb.ReceivedContents, 0.5).ShouldNot(Receive())
+			nozzle.Stop()
+
+			Eventually(stopped).Should(BeClosed())
+			Expect(startErr).ToNot(HaveOccurred())
+			var contents []byte
+			Eventually(fakeInfluxDb.ReceivedContents).Should(Receive(&contents))
+			Expect(string(contents)).To(MatchRegexp(`influxdb\.nozzle\.shutdown,[^ ]*reason=signal value=1 `))
+		})
+
+		It("flushes once per tick even when the clock jumps", func() {
+			driftPattern := regexp.MustCompile(`flushDriftMs,[^ ]* value=([0-9.]+) `)
+
+			ticks := []func(){
+				func() { fakeClock.Tick(start.Add(time.Second)) },
+				func() { fakeClock.Tick(start.Add(2 * time.Second)) },
+				func() {
+					fakeClock.SetNow(start.Add(-time.Hour))
+					fakeClock.Tick(start.Add(3 * time.Second))
+				},
+			}
+
+			// Each tick waits for the previous flush, which would otherwise
+			// read the clock already moved by the next tick.
+			for _, tick := range ticks {
+				go tick()
+				var contents []byte
+				Eventually(fakeInfluxDb.ReceivedContents, 5).Should(Receive(&contents))
+				Expect(driftPattern.FindSubmatch(contents)[1]).To(BeEquivalentTo("0"))
+			}
+			Consistently(fakeInfluxDb.ReceivedContents).ShouldNot(Receive())
+		})
+	})
+})
+
+type failingTokenFetcher struct{}
+
+func (f *failingTokenFetcher) FetchAuthToken() string {
+	panic("FetchAuthToken should not be called when TryFetchAuthToken is available")
+}
+
+func (f *failingTokenFetcher) TryFetchAuthToken() (string, error) {
+	return "", errors.New("bad credentials")
+}
@@ -0,0 +1,65 @@
+package influxdbfirehosenozzle
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+type MetricAdder interface {
+	AddMetric(envelope *events.Envelope)
+}
+
+// WorkerPool bounds the number of envelopes processed concurrently. Envelopes of the
+// same metric are always handled by the same worker so their order is preserved.
+//
+// The influxdbclient.Client parses envelopes outside its lock and takes it only to
+// buffer the resulting points, so workers build tags and keys in parallel.
+type WorkerPool struct {
+	queues []chan *events.Envelope
+	adder  MetricAdder
+	wg     sync.WaitGroup
+}
+
+func NewWorkerPool(workers int, queueSize int, adder MetricAdder) *WorkerPool {
+	pool := &WorkerPool{
+		queues: make([]chan *events.Envelope, workers),
+		adder:  adder,
+	}
+
+	for i := range pool.queues {
+		pool.queues[i] = make(chan *events.Envelope, queueSize)
+		pool.wg.Add(1)
+		go pool.work(pool.queues[i])
+	}
+
+	return pool
+}
+
+func (p *WorkerPool) Submit(envelope *events.Envelope) {
+	p.queues[p.shard(envelope)] <- envelope
+}
+
+// Stop waits until all queued envelopes have been processed.
+func (p *WorkerPool) Stop() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+}
+
+func (p *WorkerPool) work(queue <-chan *events.Envelope) {
+	defer p.wg.Done()
+	for envelope := range queue {
+		p.adder.AddMetric(envelope)
+	}
+}
+
+func (p *WorkerPool) shard(envelope *events.Envelope) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(envelope.GetOrigin()))
+	hash.Write([]byte(envelope.GetValueMetric().GetName()))
+	hash.Write([]byte(envelope.GetCounterEvent().GetName()))
+	return int(hash.Sum32() % uint32(len(p.queues)))
+}
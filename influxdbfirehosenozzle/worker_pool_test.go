@@ -0,0 +1,66 @@
+package influxdbfirehosenozzle_test
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/andrew-edgar/influxdb-firehose-nozzle/influxdbfirehosenozzle"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeMetricAdder struct {
+	sync.Mutex
+	inFlight    int
+	maxInFlight int
+	received    map[string][]int64
+}
+
+func (f *fakeMetricAdder) AddMetric(envelope *events.Envelope) {
+	f.Lock()
+	f.inFlight++
+	if f.inFlight > f.maxInFlight {
+		f.maxInFlight = f.inFlight
+	}
+	f.Unlock()
+
+	time.Sleep(time.Millisecond)
+
+	f.Lock()
+	defer f.Unlock()
+	f.inFlight--
+	f.received[envelope.GetOrigin()] = append(f.received[envelope.GetOrigin()], envelope.GetTimestamp())
+}
+
+var _ = Describe("WorkerPool", func() {
+	It("processes every metric in order without exceeding the worker count", func() {
+		adder := &fakeMetricAdder{received: make(map[string][]int64)}
+		pool := influxdbfirehosenozzle.NewWorkerPool(3, 10, adder)
+
+		for i := 0; i < 100; i++ {
+			pool.Submit(&events.Envelope{
+				Origin:    proto.String(fmt.Sprintf("origin-%d", i%10)),
+				Timestamp: proto.Int64(int64(i)),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+				},
+			})
+		}
+		pool.Stop()
+
+		Expect(adder.maxInFlight).To(BeNumerically("<=", 3))
+		Expect(adder.received).To(HaveLen(10))
+		for _, timestamps := range adder.received {
+			Expect(timestamps).To(HaveLen(10))
+			for i := 1; i < len(timestamps); i++ {
+				Expect(timestamps[i]).To(BeNumerically(">", timestamps[i-1]))
+			}
+		}
+	})
+})
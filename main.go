@@ -1,8 +1,9 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
-	"io"
 	"log"
 	"net/http"
 	"os"
@@ -14,8 +15,21 @@ import (
 	"github.com/andrew-edgar/influxdb-firehose-nozzle/logger"
 	"github.com/andrew-edgar/influxdb-firehose-nozzle/nozzleconfig"
 	"github.com/andrew-edgar/influxdb-firehose-nozzle/uaatokenfetcher"
+	"github.com/cloudfoundry/gosteno"
 )
 
+// Exit codes telling orchestration why the nozzle stopped. Any other shutdown
+// exits with 0. They stay clear of 2, which Go exits with on a panic.
+const (
+	exitConfigError     = 10
+	exitAuthFailure     = 11
+	exitInfluxDbFailure = 12
+	exitInterrupted     = 13
+)
+
+// exit is replaced in tests.
+var exit = os.Exit
+
 var (
 	logFilePath = flag.String("logFile", "", "The agent log file, defaults to STDOUT")
 	logLevel    = flag.Bool("debug", false, "Debug logging")
@@ -27,9 +41,9 @@ func main() {
 
 	log := logger.NewLogger(*logLevel, *logFilePath, "influxdb-firehose-nozzle", "")
 
-	config, err := nozzleconfig.Parse(*configFile)
-	if err != nil {
-		log.Fatalf("Error parsing config: %s", err.Error())
+	config := loadConfig(*configFile, log)
+	if config == nil {
+		return
 	}
 
 	tokenFetcher := uaatokenfetcher.New(config.UAAURL, config.Username, config.Password, config.SsLSkipVerify, log)
@@ -38,17 +52,89 @@ func main() {
 	defer close(threadDumpChan)
 	go dumpGoRoutine(threadDumpChan)
 
-	go runServer()
-
 	influxDbNozzle := influxdbfirehosenozzle.NewInfluxDbFirehoseNozzle(config, tokenFetcher, log)
-	influxDbNozzle.Start()
+
+	flushChan := registerFlushSignalChannel()
+	defer close(flushChan)
+	go influxDbNozzle.FlushOnSignal(flushChan)
+
+	stopChan := registerStopSignalChannel()
+	defer close(stopChan)
+	go stopOnSignal(influxDbNozzle.Stop, stopChan)
+
+	go runServer(influxDbNozzle)
+
+	exitOnError(influxDbNozzle.Start(), log)
+}
+
+// stopOnSignal stops the nozzle, flushing its buffered metrics, on the first
+// signal received. A second signal exits with exitInterrupted without waiting
+// for the flush to finish.
+func stopOnSignal(stop func(), signals <-chan os.Signal) {
+	if _, ok := <-signals; !ok {
+		return
+	}
+	go stop()
+	if _, ok := <-signals; ok {
+		exit(exitInterrupted)
+	}
+}
+
+// loadConfig parses the config file, exiting with exitConfigError when it is
+// invalid.
+func loadConfig(path string, log *gosteno.Logger) *nozzleconfig.NozzleConfig {
+	config, err := nozzleconfig.Parse(path)
+	if err != nil {
+		log.Errorf("Error parsing config: %s", err.Error())
+		exit(exitConfigError)
+		return nil
+	}
+	return config
 }
 
-func defaultResponse(w http.ResponseWriter, r *http.Request) {
-	io.WriteString(w, "{ \"status\" : \"running\" }")
+// exitOnError exits with the code of the failure which stopped the nozzle.
+func exitOnError(err error, log *gosteno.Logger) {
+	if code := exitCode(err); code != 0 {
+		log.Errorf("Exiting with code %d: %s", code, err.Error())
+		exit(code)
+	}
 }
 
-func runServer() {
+func exitCode(err error) int {
+	var authErr *influxdbfirehosenozzle.AuthError
+	var influxDbErr *influxdbfirehosenozzle.InfluxDbError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &authErr), influxdbfirehosenozzle.ConsumerErrorCategory(err) == influxdbfirehosenozzle.ConsumerErrorAuth:
+		return exitAuthFailure
+	case errors.As(err, &influxDbErr):
+		return exitInfluxDbFailure
+	}
+	return 0
+}
+
+type nozzleStatus struct {
+	Status                string `json:"status"`
+	TotalMessagesReceived uint64 `json:"totalMessagesReceived"`
+	TotalMetricsSent      uint64 `json:"totalMetricsSent"`
+}
+
+// statusResponse reports that the nozzle is running, with its message counts
+// once it has started.
+func statusResponse(influxDbNozzle *influxdbfirehosenozzle.InfluxDbFirehoseNozzle) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := nozzleStatus{Status: "running"}
+		if client := influxDbNozzle.Client(); client != nil {
+			status.TotalMessagesReceived = client.TotalMessagesReceived()
+			status.TotalMetricsSent = client.TotalMetricsSent()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+func runServer(influxDbNozzle *influxdbfirehosenozzle.InfluxDbFirehoseNozzle) {
 	port := os.Getenv("PORT")
 
 	log.Print("Go Port from environment: " + port)
@@ -59,7 +145,10 @@ func runServer() {
 
 	log.Print("Starting server with port: " + port)
 
-	http.HandleFunc("/", defaultResponse)
+	http.HandleFunc("/", statusResponse(influxDbNozzle))
+	if *logLevel {
+		http.HandleFunc("/debug/buffer", influxDbNozzle.ServeDebugBuffer)
+	}
 	http.ListenAndServe(":"+port, nil)
 }
 
@@ -70,6 +159,20 @@ func registerGoRoutineDumpSignalChannel() chan os.Signal {
 	return threadDumpChan
 }
 
+func registerFlushSignalChannel() chan os.Signal {
+	flushChan := make(chan os.Signal, 1)
+	signal.Notify(flushChan, syscall.SIGUSR2)
+
+	return flushChan
+}
+
+func registerStopSignalChannel() chan os.Signal {
+	stopChan := make(chan os.Signal, 1)
+	signal.Notify(stopChan, syscall.SIGTERM, syscall.SIGINT)
+
+	return stopChan
+}
+
 func dumpGoRoutine(dumpChan chan os.Signal) {
 	for range dumpChan {
 		goRoutineProfiles := pprof.Lookup("goroutine")
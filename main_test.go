@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+
+	"github.com/andrew-edgar/influxdb-firehose-nozzle/influxdbfirehosenozzle"
+	"github.com/andrew-edgar/influxdb-firehose-nozzle/testhelpers"
+	noaa_errors "github.com/cloudfoundry/noaa/errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Status response", func() {
+	It("reports zero totals before the nozzle has started", func() {
+		influxDbNozzle := influxdbfirehosenozzle.NewInfluxDbFirehoseNozzle(nil, &testhelpers.FakeTokenFetcher{}, testhelpers.Logger())
+		recorder := httptest.NewRecorder()
+
+		statusResponse(influxDbNozzle)(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		var status nozzleStatus
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &status)).To(Succeed())
+		Expect(status).To(Equal(nozzleStatus{Status: "running"}))
+	})
+})
+
+var _ = Describe("Exit codes", func() {
+	var exitCodes []int
+
+	BeforeEach(func() {
+		exitCodes = nil
+		exit = func(code int) {
+			exitCodes = append(exitCodes, code)
+		}
+	})
+
+	AfterEach(func() {
+		exit = os.Exit
+	})
+
+	It("exits with exitConfigError when the config can't be parsed", func() {
+		Expect(loadConfig("does-not-exist.json", testhelpers.Logger())).To(BeNil())
+		Expect(exitCodes).To(Equal([]int{exitConfigError}))
+	})
+
+	It("exits with exitAuthFailure when no token can be fetched", func() {
+		exitOnError(&influxdbfirehosenozzle.AuthError{Err: errors.New("bad credentials")}, testhelpers.Logger())
+		Expect(exitCodes).To(Equal([]int{exitAuthFailure}))
+	})
+
+	It("exits with exitAuthFailure when the firehose rejects the token", func() {
+		exitOnError(noaa_errors.NewUnauthorizedError("bad token"), testhelpers.Logger())
+		Expect(exitCodes).To(Equal([]int{exitAuthFailure}))
+	})
+
+	It("exits with exitInfluxDbFailure when metrics can't be posted", func() {
+		exitOnError(&influxdbfirehosenozzle.InfluxDbError{Err: errors.New("connection refused")}, testhelpers.Logger())
+		Expect(exitCodes).To(Equal([]int{exitInfluxDbFailure}))
+	})
+
+	It("exits with exitInterrupted on a second stop signal", func() {
+		signals := make(chan os.Signal, 2)
+		release := make(chan struct{})
+		defer close(release)
+		stopped := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			stopOnSignal(func() {
+				close(stopped)
+				<-release
+			}, signals)
+		}()
+
+		signals <- syscall.SIGTERM
+		Eventually(stopped).Should(BeClosed())
+		Expect(exitCodes).To(BeEmpty())
+
+		signals <- syscall.SIGINT
+		Eventually(done).Should(BeClosed())
+		Expect(exitCodes).To(Equal([]int{exitInterrupted}))
+	})
+
+	It("doesn't exit after a single stop signal", func() {
+		signals := make(chan os.Signal, 1)
+		stopped := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			stopOnSignal(func() { close(stopped) }, signals)
+		}()
+
+		signals <- syscall.SIGTERM
+		Eventually(stopped).Should(BeClosed())
+		close(signals)
+		Eventually(done).Should(BeClosed())
+		Expect(exitCodes).To(BeEmpty())
+	})
+
+	It("doesn't exit with a failure code for other shutdowns", func() {
+		exitOnError(errors.New("firehose closed"), testhelpers.Logger())
+		exitOnError(nil, testhelpers.Logger())
+		Expect(exitCodes).To(BeEmpty())
+	})
+})
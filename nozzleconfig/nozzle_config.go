@@ -4,32 +4,136 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+
+	"github.com/cloudfoundry/sonde-go/events"
 )
 
 type NozzleConfig struct {
-	UAAURL                 string
-	Username               string
-	Password               string
-	TrafficControllerURL   string
-	FirehoseSubscriptionID string
-	InfluxDbUrl            string
-	InfluxDbDatabase       string
-	InfluxDbUser           string
-	InfluxDbPassword       string
-	InfluxDbSslSkipVerify  bool
-	FlushDurationSeconds   uint32
-	SsLSkipVerify          bool
-	MetricPrefix           string
-	Deployment             string
-	DisableAccessControl   bool
-	IdleTimeoutSeconds     uint32
+	UAAURL                            string
+	Username                          string
+	Password                          string
+	TrafficControllerURL              string
+	FirehoseSubscriptionID            string
+	InfluxDbUrl                       string
+	InfluxDbDatabase                  string
+	InfluxDbUser                      string
+	InfluxDbPassword                  string
+	InfluxDbSslSkipVerify             bool
+	InfluxDbTLSServerName             string
+	InfluxDbVersion                   uint32
+	InfluxDbOrg                       string
+	InfluxDbToken                     string
+	FlushDurationSeconds              uint32
+	FlushPointCount                   uint32
+	FlushMetricCount                  uint32
+	SsLSkipVerify                     bool
+	MetricPrefix                      string
+	InternalMetricPrefix              string
+	MeasurementSuffix                 string
+	MeasurementCase                   string
+	Deployment                        string
+	DisableAccessControl              bool
+	IdleTimeoutSeconds                uint32
+	EnvelopeFieldMapping              map[string]string
+	TagNames                          map[string]string
+	EmitCounterRates                  bool
+	MetricWorkers                     uint32
+	MetricQueueSize                   uint32
+	FirehoseSilenceSeconds            uint32
+	DuplicateTagPolicy                string
+	RetentionPolicies                 map[string]string
+	ErrorBodyLogLimit                 uint32
+	ReceiveRateWindowSeconds          uint32
+	SkipIdlePosts                     bool
+	LineTerminator                    string
+	PromoteCFTags                     bool
+	ConstantFieldKey                  string
+	ConstantFieldValue                string
+	QuarantineConflictingMeasurements bool
+	MaxLineLength                     uint32
+	DataDogDualWrite                  bool
+	DataDogURL                        string
+	DataDogAPIKey                     string
+	UserAgent                         string
+	DropPointsAfterFailedPosts        uint32
+	Precision                         string
+	SecondTimestamps                  bool
+	MeasurementPrecisions             map[string]string
+	MaxRetries                        uint32
+	RetryBudgetPerMinute              uint32
+	RetryBaseDelayMilliseconds        uint32
+	RetryMaxDelayMilliseconds         uint32
+	IndexFormat                       string
+	CounterShape                      string
+	CompactRepeatedValues             bool
+	CounterFlushDurationSeconds       uint32
+	EmitRuntimeMetrics                bool
+	MaxTagsPerSeries                  uint32
+	WriteDeadlinePercent              uint32
+	RedactedTags                      []string
+	TagRedactionMode                  string
+	EmptyNamePolicy                   string
+	WriteFormat                       string
+	GzipWrites                        bool
+	GzipLevel                         uint32
+	DeploymentEventTypes              map[string][]string
+	TagSetReportSeconds               uint32
+	DNSRetryDelayMilliseconds         uint32
+	EmitSourceIDTag                   bool
+	ResetSafeCounters                 bool
+	SeparateInternalBatch             bool
+	OriginSampleRates                 map[string]float64
+	JobAggregates                     []string
+	ContainerShape                    string
+	TagOrder                          []string
+	MaxLinesPerRequest                uint32
+	StaticTags                        map[string]string
+	CounterMode                       string
+	MetricAllowList                   []string
+	MetricDenyList                    []string
+	MaxBufferBytes                    uint32
+	BufferCapAction                   string
+	FieldTypes                        map[string]string
+	UDPAddress                        string
+	UDPPayloadSize                    uint32
+	AcceptGzipResponses               bool
+	EmitHttpMetrics                   bool
+	EmitContainerMetrics              bool
+
+	// Warnings lists the non-fatal problems found while parsing the config,
+	// such as unknown fields.
+	Warnings []string `json:"-"`
+}
+
+var envelopeAttributes = map[string]bool{"deployment": true, "job": true, "index": true, "ip": true, "origin": true}
+var envelopeFieldModes = map[string]bool{"tag": true, "field": true, "omit": true}
+
+// defaultConfig holds the values of the optional fields omitted from a config
+// file. Fields present in the file, even with a zero value, replace them.
+func defaultConfig() NozzleConfig {
+	return NozzleConfig{
+		FirehoseSubscriptionID:     "influxdb-firehose-nozzle",
+		FlushDurationSeconds:       15,
+		IdleTimeoutSeconds:         60,
+		Precision:                  "ns",
+		MaxRetries:                 2,
+		RetryBaseDelayMilliseconds: 100,
+		RetryMaxDelayMilliseconds:  1000,
+		EmitSourceIDTag:            true,
+	}
 }
 
 func Parse(configPath string) (*NozzleConfig, error) {
 	configBytes, err := ioutil.ReadFile(configPath)
-	var config NozzleConfig
+	config := defaultConfig()
 	if err != nil {
 		return nil, fmt.Errorf("Can not read config file [%s]: %s", configPath, err)
 	}
@@ -39,6 +143,11 @@ func Parse(configPath string) (*NozzleConfig, error) {
 		return nil, fmt.Errorf("Can not parse config file %s: %s", configPath, err)
 	}
 
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(configBytes, &fields) == nil {
+		config.Warnings = append(config.Warnings, unknownFields(fields)...)
+	}
+
 	overrideWithEnvVar("NOZZLE_UAAURL", &config.UAAURL)
 	overrideWithEnvVar("NOZZLE_USERNAME", &config.Username)
 	overrideWithEnvVar("NOZZLE_PASSWORD", &config.Password)
@@ -49,7 +158,14 @@ func Parse(configPath string) (*NozzleConfig, error) {
 	overrideWithEnvVar("NOZZLE_INFLUXDB_USER", &config.InfluxDbUser)
 	overrideWithEnvVar("NOZZLE_INFLUXDB_PASSWORD", &config.InfluxDbPassword)
 	overrideWithEnvBool("NOZZLE_INFLUXDB_SSL_SKIPVERIFY", &config.InfluxDbSslSkipVerify)
+	overrideWithEnvVar("NOZZLE_INFLUXDB_TLS_SERVERNAME", &config.InfluxDbTLSServerName)
+	overrideWithEnvUint32("NOZZLE_INFLUXDB_VERSION", &config.InfluxDbVersion)
+	overrideWithEnvVar("NOZZLE_INFLUXDB_ORG", &config.InfluxDbOrg)
+	overrideWithEnvVar("NOZZLE_INFLUXDB_TOKEN", &config.InfluxDbToken)
 	overrideWithEnvVar("NOZZLE_METRICPREFIX", &config.MetricPrefix)
+	overrideWithEnvVar("NOZZLE_INTERNALMETRICPREFIX", &config.InternalMetricPrefix)
+	overrideWithEnvVar("NOZZLE_MEASUREMENTSUFFIX", &config.MeasurementSuffix)
+	overrideWithEnvVar("NOZZLE_MEASUREMENTCASE", &config.MeasurementCase)
 	overrideWithEnvVar("NOZZLE_DEPLOYMENT", &config.Deployment)
 
 	overrideWithEnvUint32("NOZZLE_FLUSHDURATIONSECONDS", &config.FlushDurationSeconds)
@@ -57,9 +173,250 @@ func Parse(configPath string) (*NozzleConfig, error) {
 	overrideWithEnvBool("NOZZLE_SSL_SKIPVERIFY", &config.SsLSkipVerify)
 	overrideWithEnvBool("NOZZLE_DISABLEACCESSCONTROL", &config.DisableAccessControl)
 	overrideWithEnvUint32("NOZZLE_IDLETIMEOUTSECONDS", &config.IdleTimeoutSeconds)
+	overrideWithEnvBool("NOZZLE_EMITCOUNTERRATES", &config.EmitCounterRates)
+	overrideWithEnvUint32("NOZZLE_METRICWORKERS", &config.MetricWorkers)
+	overrideWithEnvUint32("NOZZLE_METRICQUEUESIZE", &config.MetricQueueSize)
+	overrideWithEnvUint32("NOZZLE_FIREHOSESILENCESECONDS", &config.FirehoseSilenceSeconds)
+	overrideWithEnvVar("NOZZLE_DUPLICATETAGPOLICY", &config.DuplicateTagPolicy)
+	overrideWithEnvUint32("NOZZLE_ERRORBODYLOGLIMIT", &config.ErrorBodyLogLimit)
+	overrideWithEnvUint32("NOZZLE_RECEIVERATEWINDOWSECONDS", &config.ReceiveRateWindowSeconds)
+	overrideWithEnvBool("NOZZLE_SKIPIDLEPOSTS", &config.SkipIdlePosts)
+	overrideWithEnvBool("NOZZLE_PROMOTECFTAGS", &config.PromoteCFTags)
+	overrideWithEnvBool("NOZZLE_QUARANTINECONFLICTINGMEASUREMENTS", &config.QuarantineConflictingMeasurements)
+	overrideWithEnvUint32("NOZZLE_MAXLINELENGTH", &config.MaxLineLength)
+	overrideWithEnvBool("NOZZLE_DATADOGDUALWRITE", &config.DataDogDualWrite)
+	overrideWithEnvVar("NOZZLE_DATADOGURL", &config.DataDogURL)
+	overrideWithEnvVar("NOZZLE_DATADOGAPIKEY", &config.DataDogAPIKey)
+	overrideWithEnvVar("NOZZLE_USERAGENT", &config.UserAgent)
+	overrideWithEnvUint32("NOZZLE_DROPPOINTSAFTERFAILEDPOSTS", &config.DropPointsAfterFailedPosts)
+	overrideWithEnvVar("NOZZLE_PRECISION", &config.Precision)
+	overrideWithEnvBool("NOZZLE_SECONDTIMESTAMPS", &config.SecondTimestamps)
+	overrideWithEnvUint32("NOZZLE_MAXRETRIES", &config.MaxRetries)
+	overrideWithEnvUint32("NOZZLE_RETRYBUDGETPERMINUTE", &config.RetryBudgetPerMinute)
+	overrideWithEnvUint32("NOZZLE_RETRYBASEDELAYMILLISECONDS", &config.RetryBaseDelayMilliseconds)
+	overrideWithEnvUint32("NOZZLE_RETRYMAXDELAYMILLISECONDS", &config.RetryMaxDelayMilliseconds)
+	overrideWithEnvVar("NOZZLE_INDEXFORMAT", &config.IndexFormat)
+	overrideWithEnvVar("NOZZLE_COUNTERSHAPE", &config.CounterShape)
+	overrideWithEnvBool("NOZZLE_COMPACTREPEATEDVALUES", &config.CompactRepeatedValues)
+	overrideWithEnvUint32("NOZZLE_COUNTERFLUSHDURATIONSECONDS", &config.CounterFlushDurationSeconds)
+	overrideWithEnvBool("NOZZLE_EMITRUNTIMEMETRICS", &config.EmitRuntimeMetrics)
+	overrideWithEnvUint32("NOZZLE_MAXTAGSPERSERIES", &config.MaxTagsPerSeries)
+	overrideWithEnvUint32("NOZZLE_WRITEDEADLINEPERCENT", &config.WriteDeadlinePercent)
+	overrideWithEnvVar("NOZZLE_TAGREDACTIONMODE", &config.TagRedactionMode)
+	overrideWithEnvVar("NOZZLE_EMPTYNAMEPOLICY", &config.EmptyNamePolicy)
+	overrideWithEnvVar("NOZZLE_WRITEFORMAT", &config.WriteFormat)
+	overrideWithEnvBool("NOZZLE_GZIPWRITES", &config.GzipWrites)
+	overrideWithEnvUint32("NOZZLE_GZIPLEVEL", &config.GzipLevel)
+	overrideWithEnvUint32("NOZZLE_TAGSETREPORTSECONDS", &config.TagSetReportSeconds)
+	overrideWithEnvUint32("NOZZLE_DNSRETRYDELAYMILLISECONDS", &config.DNSRetryDelayMilliseconds)
+	overrideWithEnvBool("NOZZLE_EMITSOURCEIDTAG", &config.EmitSourceIDTag)
+	overrideWithEnvUint32("NOZZLE_FLUSHPOINTCOUNT", &config.FlushPointCount)
+	overrideWithEnvUint32("NOZZLE_FLUSHMETRICCOUNT", &config.FlushMetricCount)
+	overrideWithEnvBool("NOZZLE_RESETSAFECOUNTERS", &config.ResetSafeCounters)
+	overrideWithEnvBool("NOZZLE_SEPARATEINTERNALBATCH", &config.SeparateInternalBatch)
+	overrideWithEnvVar("NOZZLE_CONTAINERSHAPE", &config.ContainerShape)
+	overrideWithEnvUint32("NOZZLE_MAXLINESPERREQUEST", &config.MaxLinesPerRequest)
+	overrideWithEnvVar("NOZZLE_COUNTERMODE", &config.CounterMode)
+	overrideWithEnvUint32("NOZZLE_MAXBUFFERBYTES", &config.MaxBufferBytes)
+	overrideWithEnvVar("NOZZLE_BUFFERCAPACTION", &config.BufferCapAction)
+	overrideWithEnvVar("NOZZLE_UDPADDRESS", &config.UDPAddress)
+	overrideWithEnvUint32("NOZZLE_UDPPAYLOADSIZE", &config.UDPPayloadSize)
+	overrideWithEnvBool("NOZZLE_ACCEPTGZIPRESPONSES", &config.AcceptGzipResponses)
+	overrideWithEnvBool("NOZZLE_EMITHTTPMETRICS", &config.EmitHttpMetrics)
+	overrideWithEnvBool("NOZZLE_EMITCONTAINERMETRICS", &config.EmitContainerMetrics)
+
+	for attribute, name := range config.TagNames {
+		if !envelopeAttributes[attribute] {
+			return nil, fmt.Errorf("Unknown envelope attribute in TagNames: %s", attribute)
+		}
+		if name == "" {
+			return nil, fmt.Errorf("Empty tag name for envelope attribute %s", attribute)
+		}
+	}
+
+	for attribute, mode := range config.EnvelopeFieldMapping {
+		if !envelopeAttributes[attribute] {
+			return nil, fmt.Errorf("Unknown envelope attribute in EnvelopeFieldMapping: %s", attribute)
+		}
+		if !envelopeFieldModes[mode] {
+			return nil, fmt.Errorf("Invalid mode %q for envelope attribute %s, must be one of tag, field or omit", mode, attribute)
+		}
+	}
+
+	switch config.DuplicateTagPolicy {
+	case "", "first", "last":
+	default:
+		return nil, fmt.Errorf("Invalid DuplicateTagPolicy %q, must be first or last", config.DuplicateTagPolicy)
+	}
+
+	switch config.MeasurementCase {
+	case "", "preserve", "lower", "upper", "snake":
+	default:
+		return nil, fmt.Errorf("Invalid MeasurementCase %q, must be preserve, lower, upper or snake", config.MeasurementCase)
+	}
+
+	switch config.IndexFormat {
+	case "", "raw", "short":
+	default:
+		return nil, fmt.Errorf("Invalid IndexFormat %q, must be raw or short", config.IndexFormat)
+	}
+
+	switch config.ContainerShape {
+	case "", "measurements", "fields":
+	default:
+		return nil, fmt.Errorf("Invalid ContainerShape %q, must be measurements or fields", config.ContainerShape)
+	}
+
+	switch config.CounterMode {
+	case "", "total", "delta":
+	default:
+		return nil, fmt.Errorf("Invalid CounterMode %q, must be total or delta", config.CounterMode)
+	}
+
+	switch config.BufferCapAction {
+	case "", "flush", "drop":
+	default:
+		return nil, fmt.Errorf("Invalid BufferCapAction %q, must be flush or drop", config.BufferCapAction)
+	}
+
+	switch config.CounterShape {
+	case "", "total", "derivative":
+	default:
+		return nil, fmt.Errorf("Invalid CounterShape %q, must be total or derivative", config.CounterShape)
+	}
+
+	switch config.TagRedactionMode {
+	case "", "mask", "hash":
+	default:
+		return nil, fmt.Errorf("Invalid TagRedactionMode %q, must be mask or hash", config.TagRedactionMode)
+	}
+
+	switch config.EmptyNamePolicy {
+	case "", "keep", "skip", "placeholder":
+	default:
+		return nil, fmt.Errorf("Invalid EmptyNamePolicy %q, must be keep, skip or placeholder", config.EmptyNamePolicy)
+	}
+
+	switch config.WriteFormat {
+	case "", "line", "json":
+	default:
+		return nil, fmt.Errorf("Invalid WriteFormat %q, must be line or json", config.WriteFormat)
+	}
+
+	switch config.InfluxDbVersion {
+	case 0, 1:
+	case 2:
+		if config.InfluxDbOrg == "" {
+			return nil, fmt.Errorf("InfluxDbOrg is required by InfluxDB 2.x")
+		}
+		if config.InfluxDbToken == "" {
+			return nil, fmt.Errorf("InfluxDbToken is required by InfluxDB 2.x")
+		}
+		for _, precision := range append([]string{config.Precision}, precisionValues(config.MeasurementPrecisions)...) {
+			if precision == "m" || precision == "h" {
+				return nil, fmt.Errorf("Precision %s is not supported by InfluxDB 2.x", precision)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Invalid InfluxDbVersion %d, must be 1 or 2", config.InfluxDbVersion)
+	}
+
+	for _, pattern := range append(append([]string(nil), config.MetricAllowList...), config.MetricDenyList...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid metric pattern %q: %s", pattern, err)
+		}
+	}
+
+	for name, fieldType := range config.FieldTypes {
+		switch fieldType {
+		case "float", "int", "bool", "string":
+		default:
+			return nil, fmt.Errorf("Invalid FieldTypes type %q for metric %s, must be float, int, bool or string", fieldType, name)
+		}
+	}
+
+	switch config.Precision {
+	case "", "ns", "u", "us", "ms", "s", "m", "h", "auto":
+	default:
+		return nil, fmt.Errorf("Invalid Precision %q, must be ns, u, ms, s, m, h or auto", config.Precision)
+	}
+
+	for pattern, precision := range config.MeasurementPrecisions {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("Invalid MeasurementPrecisions pattern %q: %s", pattern, err)
+		}
+		switch precision {
+		case "ns", "u", "us", "ms", "s", "m", "h":
+		default:
+			return nil, fmt.Errorf("Invalid MeasurementPrecisions precision %q for pattern %s, must be ns, u, ms, s, m or h", precision, pattern)
+		}
+	}
+
+	for pattern := range config.RetentionPolicies {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("Invalid RetentionPolicies pattern %q: %s", pattern, err)
+		}
+	}
+
+	for deployment, eventTypes := range config.DeploymentEventTypes {
+		for _, eventType := range eventTypes {
+			if _, ok := events.Envelope_EventType_value[eventType]; !ok {
+				return nil, fmt.Errorf("Invalid DeploymentEventTypes event type %q for deployment %s", eventType, deployment)
+			}
+		}
+	}
+
+	if config.GzipLevel > 9 {
+		return nil, fmt.Errorf("Invalid GzipLevel %d, must be between 1 and 9", config.GzipLevel)
+	}
+
+	if config.UDPAddress != "" {
+		if _, err := net.ResolveUDPAddr("udp", config.UDPAddress); err != nil {
+			return nil, fmt.Errorf("Invalid UDPAddress %q: %s", config.UDPAddress, err)
+		}
+	}
+
+	for origin, rate := range config.OriginSampleRates {
+		if rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("Invalid OriginSampleRates rate %v for origin %s, must be between 0 and 1", rate, origin)
+		}
+	}
+
+	if config.UDPAddress != "" && config.WriteFormat == "json" {
+		return nil, fmt.Errorf("WriteFormat json can't be written to UDPAddress, UDP writes are line protocol")
+	}
+
+	if config.DataDogDualWrite && config.DataDogURL == "" {
+		return nil, fmt.Errorf("DataDogURL must be set when DataDogDualWrite is enabled")
+	}
 	return &config, nil
 }
 
+func precisionValues(precisions map[string]string) []string {
+	var values []string
+	for _, precision := range precisions {
+		values = append(values, precision)
+	}
+	return values
+}
+
+// unknownFields returns a warning for each field of a config file which isn't a
+// setting, such as a misspelled one, since it is otherwise silently ignored.
+func unknownFields(fields map[string]json.RawMessage) []string {
+	configType := reflect.TypeOf(NozzleConfig{})
+	var warnings []string
+	for name := range fields {
+		_, ok := configType.FieldByNameFunc(func(field string) bool {
+			return strings.EqualFold(field, name)
+		})
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("Unknown field %s is ignored", name))
+		}
+	}
+	sort.Strings(warnings)
+	return warnings
+}
+
 func overrideWithEnvVar(name string, value *string) {
 	envValue := os.Getenv(name)
 	if envValue != "" {
@@ -1,6 +1,7 @@
 package nozzleconfig_test
 
 import (
+	"io/ioutil"
 	"os"
 
 	"github.com/andrew-edgar/influxdb-firehose-nozzle/nozzleconfig"
@@ -14,17 +15,17 @@ var _ = Describe("NozzleConfig", func() {
 	})
 
 	It("successfully parses a valid config", func() {
-		conf, err := nozzleconfig.Parse("../config/datadog-firehose-nozzle.json")
+		conf, err := nozzleconfig.Parse("../config/influxdb-firehose-nozzle.json")
 		Expect(err).ToNot(HaveOccurred())
-		Expect(conf.UAAURL).To(Equal("https://uaa.walnut.cf-app.com"))
-		Expect(conf.Username).To(Equal("user"))
-		Expect(conf.Password).To(Equal("user_password"))
-		Expect(conf.DataDogURL).To(Equal("https://app.datadoghq.com/api/v1/series"))
-		Expect(conf.DataDogAPIKey).To(Equal("<enter api key>"))
+		Expect(conf.UAAURL).To(Equal("https://uaa.ketchup.cf-app.com"))
+		Expect(conf.Username).To(Equal(""))
+		Expect(conf.Password).To(Equal(""))
+		Expect(conf.InfluxDbUrl).To(Equal("http://10.10.18.150:8086"))
+		Expect(conf.InfluxDbDatabase).To(Equal("cloudfoundry"))
 		Expect(conf.FlushDurationSeconds).To(BeEquivalentTo(15))
-		Expect(conf.InsecureSSLSkipVerify).To(Equal(true))
-		Expect(conf.MetricPrefix).To(Equal("datadogclient"))
-		Expect(conf.Deployment).To(Equal("deployment-name"))
+		Expect(conf.SsLSkipVerify).To(Equal(true))
+		Expect(conf.MetricPrefix).To(Equal("cf."))
+		Expect(conf.Deployment).To(Equal("cf-ketchup"))
 		Expect(conf.DisableAccessControl).To(Equal(false))
 		Expect(conf.IdleTimeoutSeconds).To(BeEquivalentTo(60))
 	})
@@ -33,27 +34,103 @@ var _ = Describe("NozzleConfig", func() {
 		os.Setenv("NOZZLE_UAAURL", "https://uaa.walnut-env.cf-app.com")
 		os.Setenv("NOZZLE_USERNAME", "env-user")
 		os.Setenv("NOZZLE_PASSWORD", "env-user-password")
+		os.Setenv("NOZZLE_INFLUXDB_URL", "http://influxdb-env:8086")
 		os.Setenv("NOZZLE_DATADOGURL", "https://app.datadoghq-env.com/api/v1/series")
 		os.Setenv("NOZZLE_DATADOGAPIKEY", "envapi-key>")
 		os.Setenv("NOZZLE_FLUSHDURATIONSECONDS", "25")
-		os.Setenv("NOZZLE_INSECURESSLSKIPVERIFY", "false")
-		os.Setenv("NOZZLE_METRICPREFIX", "env-datadogclient")
+		os.Setenv("NOZZLE_SSL_SKIPVERIFY", "false")
+		os.Setenv("NOZZLE_METRICPREFIX", "env-cf.")
 		os.Setenv("NOZZLE_DEPLOYMENT", "env-deployment-name")
 		os.Setenv("NOZZLE_DISABLEACCESSCONTROL", "true")
 		os.Setenv("NOZZLE_IDLETIMEOUTSECONDS", "30")
 
-		conf, err := nozzleconfig.Parse("../config/datadog-firehose-nozzle.json")
+		conf, err := nozzleconfig.Parse("../config/influxdb-firehose-nozzle.json")
 		Expect(err).ToNot(HaveOccurred())
 		Expect(conf.UAAURL).To(Equal("https://uaa.walnut-env.cf-app.com"))
 		Expect(conf.Username).To(Equal("env-user"))
 		Expect(conf.Password).To(Equal("env-user-password"))
+		Expect(conf.InfluxDbUrl).To(Equal("http://influxdb-env:8086"))
 		Expect(conf.DataDogURL).To(Equal("https://app.datadoghq-env.com/api/v1/series"))
 		Expect(conf.DataDogAPIKey).To(Equal("envapi-key>"))
 		Expect(conf.FlushDurationSeconds).To(BeEquivalentTo(25))
-		Expect(conf.InsecureSSLSkipVerify).To(Equal(false))
-		Expect(conf.MetricPrefix).To(Equal("env-datadogclient"))
+		Expect(conf.SsLSkipVerify).To(Equal(false))
+		Expect(conf.MetricPrefix).To(Equal("env-cf."))
 		Expect(conf.Deployment).To(Equal("env-deployment-name"))
 		Expect(conf.DisableAccessControl).To(Equal(true))
 		Expect(conf.IdleTimeoutSeconds).To(BeEquivalentTo(30))
 	})
+
+	It("overrides the internal metric prefix with an environmental variable", func() {
+		os.Setenv("NOZZLE_INTERNALMETRICPREFIX", "env-internal.")
+
+		conf, err := nozzleconfig.Parse("../config/influxdb-firehose-nozzle.json")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.MetricPrefix).To(Equal("cf."))
+		Expect(conf.InternalMetricPrefix).To(Equal("env-internal."))
+	})
+
+	It("fills in defaults for the optional fields omitted from the config", func() {
+		configFile, err := ioutil.TempFile("", "nozzle-config")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.Remove(configFile.Name())
+		_, err = configFile.WriteString(`{"InfluxDbUrl": "http://localhost:8086", "InfluxDbDatabase": "cloudfoundry", "MaxRetries": 0}`)
+		Expect(err).ToNot(HaveOccurred())
+		configFile.Close()
+
+		conf, err := nozzleconfig.Parse(configFile.Name())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.InfluxDbUrl).To(Equal("http://localhost:8086"))
+		Expect(conf.FirehoseSubscriptionID).To(Equal("influxdb-firehose-nozzle"))
+		Expect(conf.FlushDurationSeconds).To(BeEquivalentTo(15))
+		Expect(conf.IdleTimeoutSeconds).To(BeEquivalentTo(60))
+		Expect(conf.Precision).To(Equal("ns"))
+		Expect(conf.MaxRetries).To(BeEquivalentTo(0))
+	})
+
+	It("rejects settings the InfluxDB client can't apply", func() {
+		invalid := map[string]string{
+			`"Precision": "days"`:                              "Invalid Precision",
+			`"MeasurementPrecisions": {"(": "s"}`:              "Invalid MeasurementPrecisions pattern",
+			`"MeasurementPrecisions": {"cf\\..*": "auto"}`:     "Invalid MeasurementPrecisions precision",
+			`"RetentionPolicies": {"[": "short"}`:              "Invalid RetentionPolicies pattern",
+			`"DeploymentEventTypes": {"cf": ["ValueMetrics"]}`: "Invalid DeploymentEventTypes event type",
+			`"GzipLevel": 12`:                                  "Invalid GzipLevel",
+			`"UDPAddress": "localhost"`:                        "Invalid UDPAddress",
+			`"InfluxDbVersion": 2, "InfluxDbToken": "token"`:   "InfluxDbOrg is required",
+			`"InfluxDbVersion": 2, "InfluxDbOrg": "org"`:       "InfluxDbToken is required",
+		}
+		for setting, message := range invalid {
+			configFile, err := ioutil.TempFile("", "nozzle-config")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.Remove(configFile.Name())
+			_, err = configFile.WriteString(`{"InfluxDbUrl": "http://localhost:8086", ` + setting + `}`)
+			Expect(err).ToNot(HaveOccurred())
+			configFile.Close()
+
+			_, err = nozzleconfig.Parse(configFile.Name())
+			Expect(err).To(MatchError(ContainSubstring(message)), setting)
+		}
+	})
+
+	It("counts a warning for each unknown field", func() {
+		configFile, err := ioutil.TempFile("", "nozzle-config")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.Remove(configFile.Name())
+		_, err = configFile.WriteString(`{"InfluxDbUrl": "http://localhost:8086", "flushdurationseconds": 5, "FlushDurationSecond": 10, "SslSkipVerfy": true}`)
+		Expect(err).ToNot(HaveOccurred())
+		configFile.Close()
+
+		conf, err := nozzleconfig.Parse(configFile.Name())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.Warnings).To(HaveLen(2))
+		Expect(conf.Warnings[0]).To(ContainSubstring("FlushDurationSecond"))
+		Expect(conf.Warnings[1]).To(ContainSubstring("SslSkipVerfy"))
+		Expect(conf.FlushDurationSeconds).To(BeEquivalentTo(5))
+	})
+
+	It("has no warnings for a current config", func() {
+		conf, err := nozzleconfig.Parse("../config/influxdb-firehose-nozzle.json")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.Warnings).To(BeEmpty())
+	})
 })
@@ -0,0 +1,53 @@
+package testhelpers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/andrew-edgar/influxdb-firehose-nozzle/influxdbfirehosenozzle"
+)
+
+type FakeClock struct {
+	lock  sync.Mutex
+	now   time.Time
+	ticks chan time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{
+		now:   now,
+		ticks: make(chan time.Time),
+	}
+}
+
+func (f *FakeClock) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.now
+}
+
+func (f *FakeClock) SetNow(now time.Time) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.now = now
+}
+
+// Tick sets the current time and blocks until the ticker's reader receives it.
+func (f *FakeClock) Tick(now time.Time) {
+	f.SetNow(now)
+	f.ticks <- now
+}
+
+func (f *FakeClock) NewTicker(d time.Duration) influxdbfirehosenozzle.Ticker {
+	return &fakeTicker{ticks: f.ticks}
+}
+
+type fakeTicker struct {
+	ticks chan time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.ticks
+}
+
+func (t *fakeTicker) Stop() {}
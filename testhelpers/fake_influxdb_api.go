@@ -4,10 +4,14 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"time"
 )
 
 type FakeInfluxDbAPI struct {
 	server           *httptest.Server
+	lock             sync.Mutex
+	delay            time.Duration
 	ReceivedContents chan []byte
 }
 
@@ -30,10 +34,21 @@ func (f *FakeInfluxDbAPI) URL() string {
 	return f.server.URL
 }
 
+func (f *FakeInfluxDbAPI) SetDelay(delay time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.delay = delay
+}
+
 func (f *FakeInfluxDbAPI) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	contents, _ := ioutil.ReadAll(r.Body)
 	defer r.Body.Close()
 
+	f.lock.Lock()
+	delay := f.delay
+	f.lock.Unlock()
+	time.Sleep(delay)
+
 	go func() {
 		f.ReceivedContents <- contents
 	}()
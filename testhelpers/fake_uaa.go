@@ -13,6 +13,7 @@ type FakeUAA struct {
 
 	tokenType   string
 	accessToken string
+	expiresIn   int
 
 	requested bool
 }
@@ -24,6 +25,12 @@ func NewFakeUAA(tokenType string, accessToken string) *FakeUAA {
 	}
 }
 
+func (f *FakeUAA) SetExpiresIn(expiresIn int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.expiresIn = expiresIn
+}
+
 func (f *FakeUAA) Start() {
 	f.server = httptest.NewUnstartedServer(f)
 	f.server.Start()
@@ -45,15 +52,16 @@ func (f *FakeUAA) Requested() bool {
 
 func (f *FakeUAA) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
+	f.lock.Lock()
+	defer f.lock.Unlock()
 	rw.Write([]byte(fmt.Sprintf(`
 		{
 			"token_type": "%s",
-			"access_token": "%s"
+			"access_token": "%s",
+			"expires_in": %d
 		}
-	`, f.tokenType, f.accessToken)))
-	f.lock.Lock()
+	`, f.tokenType, f.accessToken, f.expiresIn)))
 	f.requested = true
-	f.lock.Unlock()
 }
 
 func (f *FakeUAA) AuthToken() string {
@@ -1,6 +1,9 @@
 package uaatokenfetcher
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/cloudfoundry-incubator/uaago"
 	"github.com/cloudfoundry/gosteno"
 )
@@ -10,6 +13,7 @@ type UAATokenFetcher struct {
 	username              string
 	password              string
 	insecureSSLSkipVerify bool
+	tokenExpiry           time.Time
 	log                   *gosteno.Logger
 }
 
@@ -24,15 +28,32 @@ func New(uaaUrl string, username string, password string, sslSkipVerify bool, lo
 }
 
 func (uaa *UAATokenFetcher) FetchAuthToken() string {
+	authToken, err := uaa.TryFetchAuthToken()
+	if err != nil {
+		uaa.log.Fatalf("%s", err.Error())
+	}
+	return authToken
+}
+
+// TryFetchAuthToken fetches a token like FetchAuthToken, but returns failures
+// instead of exiting.
+func (uaa *UAATokenFetcher) TryFetchAuthToken() (string, error) {
 	uaaClient, err := uaago.NewClient(uaa.uaaUrl)
 	if err != nil {
-		uaa.log.Fatalf("Error creating uaa client: %s", err.Error())
+		return "", fmt.Errorf("Error creating uaa client: %s", err.Error())
 	}
 
 	var authToken string
-	authToken, err = uaaClient.GetAuthToken(uaa.username, uaa.password, uaa.insecureSSLSkipVerify)
+	var expiresIn int
+	authToken, expiresIn, err = uaaClient.GetAuthTokenWithExpiresIn(uaa.username, uaa.password, uaa.insecureSSLSkipVerify)
 	if err != nil {
-		uaa.log.Fatalf("Error getting oauth token: %s. Please check your username and password.", err.Error())
+		return "", fmt.Errorf("Error getting oauth token: %s. Please check your username and password.", err.Error())
 	}
-	return authToken
+	uaa.tokenExpiry = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	return authToken, nil
+}
+
+// TokenExpiry returns when the last fetched token expires.
+func (uaa *UAATokenFetcher) TokenExpiry() time.Time {
+	return uaa.tokenExpiry
 }
@@ -1,6 +1,8 @@
 package uaatokenfetcher_test
 
 import (
+	"time"
+
 	"github.com/andrew-edgar/influxdb-firehose-nozzle/testhelpers"
 	"github.com/andrew-edgar/influxdb-firehose-nozzle/uaatokenfetcher"
 	"github.com/cloudfoundry/gosteno"
@@ -31,4 +33,11 @@ var _ = Describe("UaaTokenFetcher", func() {
 		Expect(fakeUAA.Requested()).To(BeTrue())
 		Expect(receivedAuthToken).To(Equal(fakeToken))
 	})
+
+	It("records when the fetched token expires", func() {
+		fakeUAA.SetExpiresIn(600)
+
+		tokenFetcher.FetchAuthToken()
+		Expect(tokenFetcher.TokenExpiry()).To(BeTemporally("~", time.Now().Add(600*time.Second), time.Second))
+	})
 })